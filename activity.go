@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const activityPollInterval = 5 * time.Second
+
+// An activityWatch holds runs back while someone is using the machine, for
+// -only-when-idle. The machine is in use if there has been input on any
+// terminal (as w(1) reports it) within idleAfter or, if maxLoad is positive,
+// if the 1-minute load average less flake's own runs exceeds maxLoad.
+//
+// Like pausing, this only stops new runs from starting.
+type activityWatch struct {
+	idleAfter time.Duration
+	maxLoad   float64
+	running   func() int // the number of runs in flight
+
+	mu     sync.Mutex
+	reason string // why the machine is busy, or "" if it is idle
+}
+
+// check updates w.reason and returns it.
+func (w *activityWatch) check() string {
+	var reason string
+	if last, err := lastTerminalInput(); err == nil && !last.IsZero() {
+		if ago := time.Since(last); ago < w.idleAfter {
+			reason = fmt.Sprintf("terminal input %s ago", ago.Truncate(time.Second))
+		}
+	}
+	if reason == "" && w.maxLoad > 0 {
+		if load, err := loadAverage(); err == nil {
+			if other := load - float64(w.running()); other > w.maxLoad {
+				reason = fmt.Sprintf("load %.2f from other processes", other)
+			}
+		}
+	}
+	w.mu.Lock()
+	w.reason = reason
+	w.mu.Unlock()
+	return reason
+}
+
+func (w *activityWatch) busyReason() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason
+}
+
+// watch closes g while the machine is in use, calling changed after each
+// change, until ctx is done.
+func (w *activityWatch) watch(ctx context.Context, g *pauseGate, changed func(reason string)) {
+	ticker := time.NewTicker(activityPollInterval)
+	defer ticker.Stop()
+	for {
+		reason := w.check()
+		if busy := reason != ""; busy != g.isClosed() {
+			g.setClosed(busy)
+			changed(reason)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// artifactDir returns the directory in dir for the artifacts of run id.
+func artifactDir(dir string, id int64) string {
+	return filepath.Join(dir, fmt.Sprintf("run-%d", id))
+}
+
+// saveArtifacts writes everything known about the failed run r to its
+// directory in dir (which -diagnose may have created already) and returns
+// its name. The directory holds:
+//
+//	output.txt    combined stdout and stderr
+//	status.txt    command, error, exit status, duration, and git state
+//	env.txt       environment, one variable per line
+//	session.txt   the session's in-flight runs and recent events (run starts
+//	              and finishes across all workers, resource samples)
+//	flakedir/     copy of the run's tmpdir (without symlinks and special
+//	              files), with -tmpdir
+//	sysstate.txt  with -sysstate
+//	diagnose.txt  with -diagnose
+//	openfiles.txt open files and sockets of a hung run, on Linux
+//	backtrace.txt gdb's backtrace of the core dump of a crash, if gdb is
+//	              installed
+//
+// If compress is set, every file in the directory is then gzipped, so
+// output.txt becomes output.txt.gz, and so on.
+func saveArtifacts(dir string, r runResult, re *runError, code *gitState, session []byte, compress bool) (string, error) {
+	name := artifactDir(dir, r.id)
+	if err := os.Mkdir(name, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+	var status bytes.Buffer
+	fmt.Fprintf(&status, "command: %s\n", r.config.cmd)
+	if dir, err := filepath.Abs(r.config.cmd.dir); err == nil {
+		fmt.Fprintf(&status, "dir: %s\n", dir)
+	}
+	fmt.Fprintf(&status, "error: %s\n", re)
+	fmt.Fprintf(&status, "exit status: %d\n", re.state.ExitCode())
+	fmt.Fprintf(&status, "duration: %s\n", r.elapsed)
+	if code != nil {
+		fmt.Fprintf(&status, "code: %s\n", code)
+	}
+	if r.config.fixture != "" {
+		fmt.Fprintf(&status, "fixture: %s\n", r.config.fixture)
+	}
+	if re.core != "" {
+		fmt.Fprintf(&status, "core: %s\n", re.core)
+	}
+	if re.variant != "" {
+		fmt.Fprintf(&status, "variant: %s\n", re.variant)
+	}
+	if r.config.chaos != "" {
+		fmt.Fprintf(&status, "chaos level: %s\n", r.config.chaos)
+	}
+	if re.proxyFaults != "" {
+		fmt.Fprintf(&status, "proxy faults: %s\n", re.proxyFaults)
+	}
+	if r.config.seccomp != "" {
+		fmt.Fprintf(&status, "seccomp: %s\n", r.config.seccomp)
+	}
+	files := map[string][]byte{
+		"output.txt":  re.output,
+		"status.txt":  status.Bytes(),
+		"env.txt":     []byte(strings.Join(re.env, "\n") + "\n"),
+		"session.txt": session,
+	}
+	if re.stamped != nil {
+		files["stdout.txt"] = re.stdout
+		files["stderr.txt"] = re.stderr
+	}
+	if re.sysState != nil {
+		files["sysstate.txt"] = re.sysState
+	}
+	if re.diagnosis != nil {
+		files["diagnose.txt"] = re.diagnosis
+	}
+	if re.openFiles != nil {
+		files["openfiles.txt"] = re.openFiles
+	}
+	if re.backtrace != nil {
+		files["backtrace.txt"] = re.backtrace
+	}
+	for file, b := range files {
+		if err := os.WriteFile(filepath.Join(name, file), b, 0o644); err != nil {
+			return "", err
+		}
+	}
+	if re.tmpdir != "" {
+		if err := copyTmpdir(filepath.Join(name, "flakedir"), re.tmpdir); err != nil {
+			return name, fmt.Errorf("copying %s: %s", re.tmpdir, err)
+		}
+	}
+	if compress {
+		if err := gzipTree(name); err != nil {
+			return name, fmt.Errorf("compressing: %s", err)
+		}
+	}
+	return name, nil
+}
+
+// gzipTree replaces each regular file in dir and its subdirectories with a
+// gzipped copy named with a .gz suffix.
+func gzipTree(dir string) error {
+	// WalkDir reads each directory in full before visiting its entries,
+	// so it does not visit the .gz files as they are created.
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if err := gzipFile(path+".gz", path); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	})
+}
+
+// copyTmpdir copies the directories and regular files in the run tmpdir src
+// to dst. Unlike os.CopyFS, it skips (and logs) symlinks, sockets, and other
+// irregular files, which tests often leave behind.
+func copyTmpdir(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case d.Type().IsRegular():
+			return copyFile(target, path)
+		default:
+			log.Printf("Not copying %s to the artifacts: not a regular file (%s)", path, d.Type())
+			return nil
+		}
+	})
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// readArtifacts calls fn with the name (relative to dir, with slashes) and
+// contents of each file saved in the run directory dir, in lexical order.
+// Files saved with -compress-artifacts are decompressed, and their names do
+// not have the .gz suffix.
+func readArtifacts(dir string, fn func(name string, data []byte) error) error {
+	var compressed bool
+	if _, err := os.Stat(filepath.Join(dir, "status.txt")); err != nil {
+		if _, err := os.Stat(filepath.Join(dir, "status.txt.gz")); err != nil {
+			return fmt.Errorf("%s is not a run directory saved with -artifacts", dir)
+		}
+		compressed = true
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if compressed {
+			name = strings.TrimSuffix(name, ".gz")
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			if data, err = io.ReadAll(zr); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		return fn(filepath.ToSlash(name), data)
+	})
+}
+
+// statusFields parses a saved status.txt.
+func statusFields(status []byte) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(status), "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+func gzipFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// An artifactStore keeps a single copy of each distinct file saved in the
+// run directories of an -artifacts directory: files with the same contents
+// as one saved earlier (such as the same output from hundreds of failures)
+// are hard links to it. Every file saved is listed in contents.txt in the
+// -artifacts directory by its SHA-256, so all occurrences of a file can be
+// found.
+type artifactStore struct {
+	dir string
+
+	mu       sync.Mutex
+	contents map[string]*storedContent
+	dirs     map[string][]*storedContent // by run directory
+}
+
+// A storedContent is the contents of one or more saved files.
+type storedContent struct {
+	sum   string // SHA-256, in hex
+	size  int64
+	paths []string // the files, which are all links to the same contents
+}
+
+func newArtifactStore(dir string) *artifactStore {
+	return &artifactStore{
+		dir:      dir,
+		contents: make(map[string]*storedContent),
+		dirs:     make(map[string][]*storedContent),
+	}
+}
+
+// add replaces each file in the newly saved run directory name whose
+// contents were saved before with a link to the earlier file. It returns
+// the size of the contents that were not saved before.
+func (s *artifactStore) add(name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var size int64
+	var index bytes.Buffer
+	err := filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&index, "%s %s\n", sum, filepath.ToSlash(rel))
+		c := s.contents[sum]
+		if c != nil && replaceWithLink(path, c.paths[0]) == nil {
+			c.paths = append(c.paths, path)
+		} else {
+			// New contents, or a file system without hard links.
+			c = &storedContent{sum: sum, size: info.Size(), paths: []string{path}}
+			s.contents[sum] = c
+			size += c.size
+		}
+		s.dirs[name] = append(s.dirs[name], c)
+		return nil
+	})
+	f, ferr := os.OpenFile(filepath.Join(s.dir, "contents.txt"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if ferr == nil {
+		_, ferr = f.Write(index.Bytes())
+		if cerr := f.Close(); ferr == nil {
+			ferr = cerr
+		}
+	}
+	return size, cmp.Or(err, ferr)
+}
+
+// remove forgets the files in the run directory name, which is about to be
+// deleted, and returns the size of the contents that no other run
+// directory has.
+func (s *artifactStore) remove(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := name + string(filepath.Separator)
+	var freed int64
+	for _, c := range s.dirs[name] {
+		if len(c.paths) == 0 {
+			continue // already counted
+		}
+		c.paths = slices.DeleteFunc(c.paths, func(path string) bool { return strings.HasPrefix(path, prefix) })
+		if len(c.paths) == 0 {
+			freed += c.size
+			if s.contents[c.sum] == c {
+				delete(s.contents, c.sum)
+			}
+		}
+	}
+	delete(s.dirs, name)
+	return freed
+}
+
+// replaceWithLink replaces the file name with a hard link to target.
+func replaceWithLink(name, target string) error {
+	tmp := name + ".link"
+	if err := os.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// An artifactBudget caps the total size of the run directories in an
+// -artifacts directory by deleting the oldest ones, for -artifact-budget.
+// Contents that several run directories share are counted once, and
+// deleting a run directory frees only the contents that it alone has.
+type artifactBudget struct {
+	limit int64
+	store *artifactStore
+
+	mu      sync.Mutex
+	dirs    []string // kept, oldest first
+	total   int64
+	evicted []string
+}
+
+func newArtifactBudget(limit int64, store *artifactStore) *artifactBudget {
+	return &artifactBudget{limit: limit, store: store}
+}
+
+// add records the newly saved run directory name, whose new contents (see
+// artifactStore.add) take size bytes, and deletes the oldest directories
+// (possibly including name) until the total fits the budget.
+func (b *artifactBudget) add(name string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dirs = append(b.dirs, name)
+	b.total += size
+	for b.total > b.limit && len(b.dirs) > 0 {
+		old := b.dirs[0]
+		b.dirs = b.dirs[1:]
+		b.total -= b.store.remove(old)
+		if err := os.RemoveAll(old); err != nil {
+			log.Printf("Cannot evict artifacts %s: %s", old, err)
+		}
+		b.evicted = append(b.evicted, old)
+	}
+}
+
+// isEvicted reports whether the run directory name was deleted.
+func (b *artifactBudget) isEvicted(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Contains(b.evicted, name)
+}
+
+// report notes which run directories were evicted, if any.
+func (b *artifactBudget) report() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.evicted) == 0 {
+		return
+	}
+	names := make([]string, len(b.evicted))
+	for i, dir := range b.evicted {
+		names[i] = filepath.Base(dir)
+	}
+	log.Printf("Evicted the artifacts of %d run(s) to stay within -artifact-budget %s: %s",
+		len(b.evicted), byteSize(b.limit), strings.Join(names, ", "))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A limiter bounds the number of concurrent runs. The limit may be changed
+// while workers are waiting.
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newLimiter(limit int) *limiter {
+	l := &limiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits for a slot to become available or for ctx to be done.
+func (l *limiter) acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.cond.Wait()
+	}
+	l.active++
+	return nil
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.cond.Signal()
+	l.mu.Unlock()
+}
+
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *limiter) getLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// parsePercent parses a percentage such as "75%" or "75" as a fraction.
+func parsePercent(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || f <= 0 || f > 100 {
+		return 0, fmt.Errorf("%q is not a percentage in (0, 100]", s)
+	}
+	return f / 100, nil
+}
+
+const autoscaleInterval = 2 * time.Second
+
+// autoscale periodically samples system-wide CPU utilization and adjusts the
+// limit of l to hold utilization near target, between 1 and maxRuns.
+func autoscale(ctx context.Context, l *limiter, target float64, maxRuns int) {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+	prevBusy, prevTotal, err := cpuTimes()
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		busy, total, err := cpuTimes()
+		if err != nil || total == prevTotal {
+			continue
+		}
+		util := float64(busy-prevBusy) / float64(total-prevTotal)
+		prevBusy, prevTotal = busy, total
+
+		// Scale the limit proportionally, but at most double it in one
+		// step since utilization lags behind newly started runs.
+		cur := l.getLimit()
+		next := 2 * cur
+		if util > 0 {
+			next = min(next, int(math.Round(float64(cur)*target/util)))
+		}
+		l.setLimit(max(1, min(next, maxRuns)))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// bisectStepEnv is set in the environment of the flake bisect processes that
+// git bisect run starts to test each commit.
+const bisectStepEnv = "FLAKE_BISECT_STEP"
+
+// Exit statuses of a flake bisect step, as git bisect run interprets them.
+const (
+	bisectGood  = 0
+	bisectBad   = 1
+	bisectSkip  = 125
+	bisectAbort = 255
+)
+
+// bisectFlags defines the flags of flake bisect.
+func bisectFlags() (fs *flag.FlagSet, good, bad, rate, confidence *string, parallelism *int) {
+	fs = flag.NewFlagSet("flake bisect", flag.ExitOnError)
+	good = fs.String("good", "", "A commit where the command does not fail (required)")
+	bad = fs.String("bad", "HEAD", "A commit where the command fails")
+	rate = fs.String("rate", "1%", "The lowest failure rate (such as 0.01 or 1%) at which to call\na commit bad: the failure rate of the command at the bad commit,\nor a little less")
+	confidence = fs.String("confidence", "95%", "Run the command at each commit until it fails or until its\nfailure rate is below -rate with this confidence")
+	parallelism = fs.Int("p", runtime.GOMAXPROCS(0), "Run this many processes in parallel")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake bisect -good <commit> [flags...] <command> [args...]
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+Flake bisect finds the commit that made a command flaky (or flakier) by
+running git bisect in the current directory. At each commit, it runs the
+command until it fails, which makes the commit bad, or until the failure rate
+is below -rate with -confidence, which makes it good. A single failure is
+conclusive, but a commit that is bad can pass by chance, with probability
+below 1 - confidence if the command fails at least as often as -rate.
+
+The command is run as is at each commit, so it should build what it tests
+(as go test does). Flake bisect leaves the repository at the commit where it
+started.
+`)
+	}
+	return fs, good, bad, rate, confidence, parallelism
+}
+
+func bisectMain(args []string) {
+	fs, good, bad, rate, confidence, parallelism := bisectFlags()
+	fs.Parse(args)
+	if fs.NArg() == 0 || *good == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *parallelism < 1 {
+		log.Fatalln("-p must be positive")
+	}
+	gate, err := parseVerify(*rate, *confidence)
+	if err != nil {
+		log.Fatalln("Bad -rate or -confidence:", err)
+	}
+	cmd := &command{args: fs.Args()}
+	if os.Getenv(bisectStepEnv) != "" {
+		os.Exit(bisectStep(cmd, gate, *parallelism))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Cannot run git bisect:", err)
+	}
+	// Leave ^C to git and the steps, so that the bisection can be reset.
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt, syscall.SIGTERM)
+	log.Printf("Bisecting %s..%s with up to %d run(s) per commit (%s)", *good, *bad, gate.runsNeeded(), gate.spec)
+	if err := git("bisect", "start", *bad, *good); err != nil {
+		log.Fatalln("Cannot start git bisect:", err)
+	}
+	run := exec.Command("git", append([]string{"bisect", "run", exe}, os.Args[1:]...)...)
+	run.Env = append(os.Environ(), bisectStepEnv+"=1")
+	run.Stdout = os.Stderr
+	run.Stderr = os.Stderr
+	runErr := run.Run()
+	var first string
+	if runErr == nil {
+		if out, err := exec.Command("git", "show", "-s", "--format=%h %s", "refs/bisect/bad").Output(); err == nil {
+			first = strings.TrimSpace(string(out))
+		}
+	}
+	if err := git("bisect", "reset"); err != nil {
+		log.Println("Cannot reset git bisect:", err)
+	}
+	if runErr != nil {
+		log.Fatalln("git bisect run failed:", runErr)
+	}
+	if first == "" {
+		log.Fatalln("Cannot tell which commit git bisect found")
+	}
+	fmt.Printf("First bad commit: %s\n", first)
+}
+
+// git runs a git command, sending its output to stderr.
+func git(args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// bisectStep decides whether the checked-out commit is good or bad, as
+// described by flake bisect -h, and returns the exit status for git bisect
+// run.
+func bisectStep(cmd *command, gate *failureGate, parallelism int) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	commit := "the current commit"
+	if out, err := exec.Command("git", "show", "-s", "--format=%h", "HEAD").Output(); err == nil {
+		commit = strings.TrimSpace(string(out))
+	}
+	n := gate.runsNeeded()
+	var (
+		leaks   leakAudit
+		wg      sync.WaitGroup
+		started atomic.Int64
+		mu      sync.Mutex
+		passed  int64
+		failure error
+	)
+	for i := 1; i <= parallelism; i++ {
+		w := &worker{num: i, numaNode: -1, leaks: &leaks}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				id := started.Add(1)
+				if id > n {
+					return
+				}
+				err := w.run(ctx, id, runConfig{cmd: cmd})
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				if err == nil {
+					passed++
+				} else if failure == nil {
+					failure = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	switch {
+	case failure != nil:
+		if _, ok := failure.(*runError); !ok {
+			log.Printf("Commit %s: cannot run the command, skipping: %s", commit, failure)
+			return bisectSkip
+		}
+		log.Printf("Commit %s: bad (%s after %d passing run(s))", commit, failure, passed)
+		return bisectBad
+	case passed < n:
+		log.Printf("Commit %s: interrupted", commit)
+		return bisectAbort
+	}
+	log.Printf("Commit %s: good (%d passing run(s), so the failure rate is below %g%% with %g%% confidence)",
+		commit, passed, 100*gate.maxRate, 100*gate.confidence)
+	return bisectGood
+}
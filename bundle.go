@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleFlags defines the flags of flake bundle.
+func bundleFlags() (fs *flag.FlagSet, out *string) {
+	fs = flag.NewFlagSet("flake bundle", flag.ExitOnError)
+	out = fs.String("o", "", "Write the bundle to this file (default <run dir>.tar.gz in the\ncurrent directory)")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake bundle [flags...] <run dir>
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+Flake bundle packs everything that flake -artifacts saved for a failing run
+(such as flake-123/run-7) into a single .tar.gz file to attach to a bug report
+or hand to a teammate: the run's output, status, environment, and tmpdir
+contents (decompressed, if saved with -compress-artifacts), and a repro.sh
+script that reruns the command in the same environment.
+`)
+	}
+	return fs, out
+}
+
+func bundleMain(args []string) {
+	fs, out := bundleFlags()
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := filepath.Clean(fs.Arg(0))
+	if *out == "" {
+		*out = filepath.Base(dir) + ".tar.gz"
+	}
+	if err := writeBundle(*out, dir); err != nil {
+		os.Remove(*out)
+		log.Fatalln("Cannot bundle artifacts:", err)
+	}
+	log.Printf("Wrote %s", *out)
+}
+
+// writeBundle writes the artifacts in the run directory dir, and a repro.sh
+// script, to a gzipped tar file named name.
+func writeBundle(name, dir string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	prefix := filepath.Base(dir) + "/"
+	now := time.Now()
+	add := func(file string, mode int64, data []byte) error {
+		hdr := &tar.Header{
+			Name:    prefix + file,
+			Mode:    mode,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	var status, env []byte
+	err = readArtifacts(dir, func(file string, data []byte) error {
+		switch file {
+		case "status.txt":
+			status = data
+		case "env.txt":
+			env = data
+		}
+		return add(file, 0o644, data)
+	})
+	if err != nil {
+		return err
+	}
+	repro, err := reproScript(filepath.Base(dir), status, env)
+	if err != nil {
+		return err
+	}
+	if err := add("repro.sh", 0o755, repro); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// reproScript returns a shell script that reruns the command of the saved
+// run named run, given its status.txt and env.txt.
+func reproScript(run string, status, env []byte) ([]byte, error) {
+	fields := statusFields(status)
+	if fields["command"] == "" {
+		return nil, errors.New("no command in status.txt")
+	}
+	vars := strings.Split(strings.TrimSuffix(string(env), "\n"), "\n")
+	var flakedir string
+	for _, v := range vars {
+		if dir, ok := strings.CutPrefix(v, "FLAKEDIR="); ok {
+			flakedir = dir
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Reruns %s of a flake session: the same command in the same environment", run)
+	if flakedir != "" {
+		fmt.Fprintf(&b, ",\n# with a new, empty $FLAKEDIR (the failing run's is in flakedir/).\n")
+		fmt.Fprintf(&b, "FLAKEDIR=$(mktemp -d) || exit 1\n")
+	} else {
+		fmt.Fprintf(&b, ".\n")
+	}
+	if dir := fields["dir"]; dir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", quoteCommand([]string{dir}))
+	}
+	fmt.Fprintf(&b, "exec env -i \\\n")
+	for _, v := range vars {
+		if v == "" {
+			continue
+		}
+		// Point everything in the old tmpdir at the new one.
+		name, value, _ := strings.Cut(v, "=")
+		if rest, ok := strings.CutPrefix(value, flakedir); ok && flakedir != "" {
+			word := quoteCommand([]string{name + "="}) + `"$FLAKEDIR"`
+			if rest != "" {
+				word += quoteCommand([]string{rest})
+			}
+			fmt.Fprintf(&b, "\t%s \\\n", word)
+		} else {
+			fmt.Fprintf(&b, "\t%s \\\n", quoteCommand([]string{v}))
+		}
+	}
+	fmt.Fprintf(&b, "\t%s\n", fields["command"])
+	return b.Bytes(), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// clockJumpThreshold is how far the wall clock must move relative to the
+// monotonic clock during a run to count as a clock jump. (NTP slewing moves it
+// by microseconds; suspending the machine or stepping the clock moves it by
+// much more.)
+const clockJumpThreshold = time.Second
+
+// clockJump returns how far the wall clock jumped relative to the monotonic
+// clock between start and end (both from time.Now), or 0 if it is less than
+// clockJumpThreshold. The monotonic clock does not advance while the machine
+// is suspended, so a suspend shows up as a forward jump.
+func clockJump(start, end time.Time) time.Duration {
+	jump := end.Round(0).Sub(start.Round(0)) - end.Sub(start)
+	if jump.Abs() < clockJumpThreshold {
+		return 0
+	}
+	return jump.Round(time.Millisecond)
+}
+
+// workerClockOffset returns the -clock-skew offset for worker num of up to
+// parallelism workers: the offsets are spread evenly from -skew to +skew
+// and rounded to whole seconds, which is what faketime supports.
+func workerClockOffset(num, parallelism int, skew time.Duration) time.Duration {
+	if parallelism < 2 {
+		return 0
+	}
+	i := (num - 1) % parallelism
+	offset := -skew + 2*skew*time.Duration(i)/time.Duration(parallelism-1)
+	return offset.Round(time.Second)
+}
+
+// faketimeWrapper returns a wrapper that runs a command with its clock
+// offset by d, using faketime (libfaketime). It only affects programs that
+// get the time through the C library; Go programs read the clock directly.
+func faketimeWrapper(d time.Duration) []string {
+	return []string{"faketime", "-f", fmt.Sprintf("%+d", int64(d/time.Second))}
+}
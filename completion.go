@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// hiddenFlags are flags that are not listed in the usage message.
+var hiddenFlags = map[string]bool{
+	"completion": true,
+}
+
+type completionFlag struct {
+	name     string
+	desc     string // usage, on one line
+	hasValue bool
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		desc := strings.ReplaceAll(f.Usage, "\n", " ")
+		cf := completionFlag{name: f.Name, desc: desc, hasValue: true}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			cf.hasValue = false
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+// A completionCommand is one of flake's subcommands.
+type completionCommand struct {
+	name  string
+	desc  string
+	flags []completionFlag
+	// The arguments after the flags are a command line to complete as
+	// such if command is set, or else files, the first of which may
+	// instead be one of the fixed words in first.
+	command bool
+	first   []string
+}
+
+func completionCommands() []completionCommand {
+	triage, _, _ := triageFlags()
+	order, _, _, _ := orderFlags()
+	bisect, _, _, _, _, _ := bisectFlags()
+	mergeReport, _ := mergeReportFlags()
+	report, _, _ := reportFlags()
+	bundle, _ := bundleFlags()
+	return []completionCommand{
+		{name: "triage", desc: "rank suspect commands by how often they fail", flags: completionFlags(triage)},
+		{name: "order", desc: "find tests that fail only after certain other tests", flags: completionFlags(order), command: true},
+		{name: "bisect", desc: "find the commit that made a command flaky", flags: completionFlags(bisect), command: true},
+		{name: "report", desc: "report on a session recorded with -json", flags: completionFlags(report)},
+		{name: "bundle", desc: "pack the artifacts of a failing run into one file", flags: completionFlags(bundle)},
+		{name: "diff", desc: "compare the artifacts of two failing runs", flags: completionFlags(diffFlags())},
+		{name: "merge-report", desc: "combine the -json output of several sessions", flags: completionFlags(mergeReport)},
+		{name: "history", desc: "compare two sessions recorded with -json", flags: completionFlags(historyFlags()), first: []string{"diff"}},
+	}
+}
+
+// writeCompletion writes a completion script for the given shell to w.
+// Flags are completed before the command; after that, completion is
+// delegated to the shell's completion for the command itself. The first
+// argument may also be a subcommand, whose flags and arguments are
+// completed in turn.
+func writeCompletion(w io.Writer, shell string) error {
+	flags := completionFlags(flag.CommandLine)
+	cmds := completionCommands()
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, flags, cmds)
+	case "zsh":
+		writeZshCompletion(w, flags, cmds)
+	case "fish":
+		writeFishCompletion(w, flags, cmds)
+	default:
+		return fmt.Errorf("unsupported shell %q (want bash, zsh, or fish)", shell)
+	}
+	return nil
+}
+
+// bashFlagNames returns the names of flags, as words, and the names of the
+// flags that take a value, as a case pattern (or "" if there are none).
+func bashFlagNames(flags []completionFlag) (names, valuePattern string) {
+	var all, values []string
+	for _, f := range flags {
+		all = append(all, "-"+f.name)
+		if f.hasValue {
+			values = append(values, "-"+f.name, "--"+f.name)
+		}
+	}
+	return strings.Join(all, " "), strings.Join(values, "|")
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag, cmds []completionCommand) {
+	names, valuePattern := bashFlagNames(flags)
+	var cmdNames, cmdCases []string
+	for _, c := range cmds {
+		cmdNames = append(cmdNames, c.name)
+		cmdCases = append(cmdCases, fmt.Sprintf("\t\t%s)\n\t\t\t_flake_%s\n\t\t\treturn\n\t\t\t;;",
+			c.name, strings.ReplaceAll(c.name, "-", "_")))
+	}
+	fmt.Fprintf(w, `_flake() {
+	local cur=${COMP_WORDS[COMP_CWORD]} i
+	if ((COMP_CWORD > 1)); then
+		case ${COMP_WORDS[1]} in
+%[3]s
+		esac
+	fi
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		--)
+			_command_offset $((i + 1))
+			return
+			;;
+		%[1]s)
+			((i++))
+			;;
+		-*) ;;
+		*)
+			_command_offset $i
+			return
+			;;
+		esac
+	done
+	case ${COMP_WORDS[COMP_CWORD-1]} in
+	%[1]s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W %[2]q -- "$cur"))
+	else
+		COMPREPLY=($(compgen -c -- "$cur"))
+		if ((COMP_CWORD == 1)); then
+			COMPREPLY+=($(compgen -W %[4]q -- "$cur"))
+		fi
+	fi
+}
+complete -F _flake flake
+`, valuePattern, names, strings.Join(cmdCases, "\n"), strings.Join(cmdNames, " "))
+	for _, c := range cmds {
+		writeBashSubcommand(w, c)
+	}
+}
+
+func writeBashSubcommand(w io.Writer, c completionCommand) {
+	names, valuePattern := bashFlagNames(c.flags)
+	var valueCase, prevCase string
+	if valuePattern != "" {
+		valueCase = fmt.Sprintf("\t\t%s)\n\t\t\t((i++))\n\t\t\t;;\n", valuePattern)
+		prevCase = fmt.Sprintf(`		case ${COMP_WORDS[COMP_CWORD-1]} in
+		%s)
+			COMPREPLY=($(compgen -f -- "$cur"))
+			return
+			;;
+		esac
+`, valuePattern)
+	}
+	positional := "\t\t\targs=1\n\t\t\tbreak\n"
+	complete := `COMPREPLY=($(compgen -f -- "$cur"))`
+	if c.command {
+		positional = "\t\t\t_command_offset $i\n\t\t\treturn\n"
+		complete = `COMPREPLY=($(compgen -c -- "$cur"))`
+	} else if len(c.first) > 0 {
+		complete = fmt.Sprintf(`if ((args)); then
+		COMPREPLY=($(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	fi`, strings.Join(c.first, " "))
+	}
+	fmt.Fprintf(w, `
+_flake_%[1]s() {
+	local cur=${COMP_WORDS[COMP_CWORD]} i args=0
+	for ((i = 2; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+%[2]s		-*) ;;
+		*)
+%[3]s			;;
+		esac
+	done
+	if ((!args)); then
+%[4]s		if [[ $cur == -* ]]; then
+			COMPREPLY=($(compgen -W %[5]q -- "$cur"))
+			return
+		fi
+	fi
+	%[6]s
+}
+`, strings.ReplaceAll(c.name, "-", "_"), valueCase, positional, prevCase, names, complete)
+}
+
+var zshReplacer = strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+
+// writeZshSpecs writes the _arguments specs of flags.
+func writeZshSpecs(w io.Writer, indent string, flags []completionFlag) {
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, zshReplacer.Replace(f.desc))
+		if f.hasValue {
+			spec += ":" + f.name + ":_files"
+		}
+		fmt.Fprintf(w, "%s'%s' \\\n", indent, spec)
+	}
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag, cmds []completionCommand) {
+	fmt.Fprintln(w, "#compdef flake")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_flake_commands() {")
+	fmt.Fprintln(w, "\tlocal -a subcommands")
+	fmt.Fprintln(w, "\tsubcommands=(")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", c.name, zshReplacer.Replace(c.desc))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\t_describe -t subcommands 'flake subcommand' subcommands")
+	fmt.Fprintln(w, "\t_command_names -e")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_flake_arguments() {")
+	fmt.Fprintln(w, "\tcase $words[1] in")
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t%s)\n", c.name)
+		fmt.Fprintln(w, "\t\t_arguments -S \\")
+		writeZshSpecs(w, "\t\t\t", c.flags)
+		switch {
+		case c.command:
+			fmt.Fprintln(w, "\t\t\t'(-)1:command:_command_names -e' \\")
+			fmt.Fprintln(w, "\t\t\t'*::arguments:_normal'")
+		case len(c.first) > 0:
+			fmt.Fprintf(w, "\t\t\t'1:%s:(%s)' \\\n", c.name, strings.Join(c.first, " "))
+			fmt.Fprintln(w, "\t\t\t'*:file:_files'")
+		default:
+			fmt.Fprintln(w, "\t\t\t'*:file:_files'")
+		}
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\t*)")
+	fmt.Fprintln(w, "\t\t_normal")
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_arguments -S \\")
+	writeZshSpecs(w, "\t", flags)
+	fmt.Fprintln(w, "\t'(-)1:command:_flake_commands' \\")
+	fmt.Fprintln(w, "\t'*::arguments:_flake_arguments'")
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag, cmds []completionCommand) {
+	var valueCases, cmdNames []string
+	for _, f := range flags {
+		if f.hasValue {
+			valueCases = append(valueCases, "-"+f.name, "--"+f.name)
+		}
+	}
+	for _, c := range cmds {
+		cmdNames = append(cmdNames, c.name)
+	}
+	fmt.Fprintf(w, `function __fish_flake_subcommand
+    set -l tokens (commandline -opc)
+    test (count $tokens) -ge 2; and contains -- $tokens[2] %[2]s
+end
+
+function __fish_flake_using_subcommand
+    set -l tokens (commandline -opc)
+    test (count $tokens) -ge 2; and test $tokens[2] = $argv[1]
+end
+
+function __fish_flake_command_index
+    __fish_flake_subcommand; and return 1
+    set -l tokens (commandline -opc)
+    set -l i 2
+    while test $i -le (count $tokens)
+        switch $tokens[$i]
+            case --
+                math $i + 1
+                return
+            case %[1]s
+                set i (math $i + 2)
+            case '-*'
+                set i (math $i + 1)
+            case '*'
+                echo $i
+                return
+        end
+    end
+    return 1
+end
+
+function __fish_flake_complete_command
+    set -l i (__fish_flake_command_index)
+    set -l tokens (commandline -opc) (commandline -ct)
+    complete -C (string join -- ' ' (string escape -- $tokens[$i..-1]))
+end
+
+complete -c flake -n __fish_flake_command_index -x -a '(__fish_flake_complete_command)'
+complete -c flake -n 'not __fish_flake_command_index; and not __fish_flake_subcommand' -f -a '(__fish_complete_command)'
+`, strings.Join(valueCases, " "), strings.Join(cmdNames, " "))
+	r := strings.NewReplacer(`\`, `\\`, "'", `\'`)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c flake -n 'test (count (commandline -opc)) -eq 1' -f -a %s -d '%s'\n", c.name, r.Replace(c.desc))
+	}
+	for _, f := range flags {
+		fmt.Fprintf(w, "complete -c flake -n 'not __fish_flake_command_index; and not __fish_flake_subcommand' -o %s -d '%s'", f.name, r.Replace(f.desc))
+		if f.hasValue {
+			fmt.Fprint(w, " -r -F")
+		}
+		fmt.Fprintln(w)
+	}
+	for _, c := range cmds {
+		cond := "__fish_flake_using_subcommand " + c.name
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "complete -c flake -n '%s' -o %s -d '%s'", cond, f.name, r.Replace(f.desc))
+			if f.hasValue {
+				fmt.Fprint(w, " -r -F")
+			}
+			fmt.Fprintln(w)
+		}
+		switch {
+		case c.command:
+			fmt.Fprintf(w, "complete -c flake -n '%s' -a '(__fish_complete_command)'\n", cond)
+		case len(c.first) > 0:
+			fmt.Fprintf(w, "complete -c flake -n '%s; and test (count (commandline -opc)) -eq 2' -f -a '%s'\n", cond, strings.Join(c.first, " "))
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// enableVT reports whether the terminal that f writes to processes VT escape
+// sequences, which terminals outside Windows do.
+func enableVT(f *os.File) bool { return true }
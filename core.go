@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// coreBacktraceTimeout is how long gdb gets to print the backtrace of a
+// core dump.
+const coreBacktraceTimeout = time.Minute
+
+// coreSpecifierRx matches the % specifiers of a core_pattern.
+var coreSpecifierRx = regexp.MustCompile(`%.`)
+
+// findCore returns the name of the newest core dump written since start by
+// a run that crashed in dir, or "" if there is none. It only finds cores
+// that the system writes to files, not ones it pipes to a program (such as
+// systemd-coredump or apport).
+func findCore(dir string, start time.Time) string {
+	pattern := corePattern()
+	if pattern == "" || strings.HasPrefix(pattern, "|") {
+		return ""
+	}
+	// The specifiers (such as %p for the PID) may be anything, since the
+	// core may be from a child of the run.
+	glob := coreSpecifierRx.ReplaceAllStringFunc(pattern, func(s string) string {
+		if s == "%%" {
+			return "%"
+		}
+		return "*"
+	})
+	if !filepath.IsAbs(glob) {
+		var err error
+		if glob, err = filepath.Abs(filepath.Join(dir, glob)); err != nil {
+			return ""
+		}
+	}
+	matches, _ := filepath.Glob(glob)
+	var core string
+	var newest time.Time
+	for _, name := range matches {
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(start) {
+			continue
+		}
+		if core == "" || info.ModTime().After(newest) {
+			core, newest = name, info.ModTime()
+		}
+	}
+	return core
+}
+
+// corePattern returns where the system writes core dumps, in the form of
+// Linux's core_pattern, or "" if it is unknown.
+func corePattern() string {
+	switch runtime.GOOS {
+	case "linux":
+		b, err := os.ReadFile("/proc/sys/kernel/core_pattern")
+		if err != nil {
+			return ""
+		}
+		pattern := strings.TrimSpace(string(b))
+		if !strings.Contains(pattern, "%p") {
+			if b, err := os.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(b)) == "1" {
+				pattern += ".%p"
+			}
+		}
+		return pattern
+	case "darwin":
+		return "/cores/core.%P"
+	}
+	return ""
+}
+
+// coreBacktrace returns the backtrace that gdb prints of the core dump,
+// using the symbols of exe if it is nonempty. It returns nil if gdb is not
+// installed.
+func coreBacktrace(core, exe string) []byte {
+	gdb, err := exec.LookPath("gdb")
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), coreBacktraceTimeout)
+	defer cancel()
+	args := []string{"-batch", "-nx", "-ex", "bt"}
+	if exe != "" {
+		args = append(args, exe, core)
+	} else {
+		args = append(args, "-c", core)
+	}
+	out, err := exec.CommandContext(ctx, gdb, args...).CombinedOutput()
+	if err != nil {
+		out = fmt.Appendf(out, "(gdb: %s)\n", err)
+	}
+	return out
+}
+
+// commandPath returns the path of the program that a command named name,
+// run in dir, runs, or "" if it cannot be found.
+func commandPath(name, dir string) string {
+	if strings.ContainsRune(name, filepath.Separator) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return name
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const crashEvents = 100
+
+// A crashRecorder keeps a log of recent session events so that if a worker
+// panics, flake can save a record of what the workers were doing before
+// shutting down. The same record goes into the artifacts of failing runs, to
+// show what else was going on when they failed.
+type crashRecorder struct {
+	mu      sync.Mutex
+	workers []*worker
+	events  [crashEvents]string // ring buffer
+	next    int                 // total number of events
+	once    sync.Once
+	crashed chan struct{} // closed after a crash is recorded
+	file    string        // the crash file, once crashed is closed
+	err     error         // the panic, or an error saving it
+}
+
+func newCrashRecorder() *crashRecorder {
+	return &crashRecorder{crashed: make(chan struct{})}
+}
+
+func (c *crashRecorder) addWorker(w *worker) {
+	c.mu.Lock()
+	c.workers = append(c.workers, w)
+	c.mu.Unlock()
+}
+
+// event records an event.
+func (c *crashRecorder) event(format string, args ...any) {
+	msg := time.Now().Format("15:04:05.000000 ") + fmt.Sprintf(format, args...)
+	c.mu.Lock()
+	c.events[c.next%crashEvents] = msg
+	c.next++
+	c.mu.Unlock()
+}
+
+// catch must be deferred by each worker goroutine. If the goroutine panics,
+// catch writes a crash file and calls cancel to shut down the session.
+func (c *crashRecorder) catch(cancel func()) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	c.once.Do(func() {
+		c.file, c.err = c.save(v, stack)
+		if c.err == nil {
+			c.err = fmt.Errorf("panic: %v", v)
+		}
+		close(c.crashed)
+	})
+	cancel()
+}
+
+func (c *crashRecorder) save(v any, stack []byte) (string, error) {
+	var b bytes.Buffer
+	c.mu.Lock()
+	fmt.Fprintf(&b, "flake crashed at %s: panic: %v\n\n%s\n", time.Now().Format(time.RFC3339), v, stack)
+	c.writeRecent(&b)
+	c.mu.Unlock()
+
+	f, err := os.CreateTemp("", "flake-crash-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("panic: %v (cannot save crash file: %s)", v, err)
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return "", fmt.Errorf("panic: %v (cannot save crash file: %s)", v, err)
+	}
+	return f.Name(), f.Close()
+}
+
+// recent returns a description of the in-flight runs and the recent events.
+func (c *crashRecorder) recent() []byte {
+	var b bytes.Buffer
+	c.mu.Lock()
+	c.writeRecent(&b)
+	c.mu.Unlock()
+	return b.Bytes()
+}
+
+// writeRecent writes the in-flight runs and the recent events to b. The
+// caller must hold c.mu.
+func (c *crashRecorder) writeRecent(b *bytes.Buffer) {
+	fmt.Fprintln(b, "In-flight runs:")
+	for _, w := range c.workers {
+		id := w.runID.Load()
+		if id == 0 {
+			continue
+		}
+		age := time.Since(time.Unix(0, w.runStart.Load())).Truncate(time.Millisecond)
+		fmt.Fprintf(b, "  worker %d: run %d, started %s ago\n", w.num, id, age)
+	}
+	fmt.Fprintln(b, "\nRecent events:")
+	for i := max(0, c.next-crashEvents); i < c.next; i++ {
+		fmt.Fprintf(b, "  %s\n", c.events[i%crashEvents])
+	}
+}
+
+const resourceSampleInterval = time.Second
+
+// sampleResources records the system's CPU utilization and available memory
+// as an event every second until ctx is done. It does nothing where they are
+// not available.
+func (c *crashRecorder) sampleResources(ctx context.Context) {
+	busy0, total0, err := cpuTimes()
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(resourceSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		busy, total, err := cpuTimes()
+		if err != nil {
+			return
+		}
+		msg := "resources: CPU "
+		if total > total0 {
+			msg += fmt.Sprintf("%.0f%% busy", 100*float64(busy-busy0)/float64(total-total0))
+		} else {
+			msg += "unknown"
+		}
+		busy0, total0 = busy, total
+		if avail, err := memAvailable(); err == nil {
+			msg += fmt.Sprintf(", %s memory available", byteSize(avail))
+		}
+		c.event("%s", msg)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+const (
+	// A run that fails within crashLoopFast counts toward a crash loop.
+	crashLoopFast = 100 * time.Millisecond
+	// crashLoopRuns fast failures in a row are a crash loop.
+	crashLoopRuns = 20
+)
+
+// A crashLoopDetector notices when a command that used to pass starts
+// failing instantly on every run, which usually means that the program was
+// deleted or broken in the middle of the session rather than that it is
+// flaky.
+type crashLoopDetector struct {
+	passed bool // any run has passed
+	streak int  // fast failures in a row
+}
+
+// observe records a finished run and reports whether the runs have just
+// turned into a crash loop.
+func (d *crashLoopDetector) observe(r runResult) bool {
+	if r.err == nil {
+		d.passed = true
+		d.streak = 0
+		return false
+	}
+	if _, ok := r.err.(*runError); !ok || r.elapsed >= crashLoopFast {
+		d.streak = 0
+		return false
+	}
+	d.streak++
+	if d.passed && d.streak >= crashLoopRuns {
+		d.streak = 0
+		return true
+	}
+	return false
+}
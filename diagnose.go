@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cespare/flake/flakerun"
+)
+
+const diagnoseTimeout = time.Minute
+
+// runDiagnose runs the user's -diagnose command for a failed run and
+// returns its combined output. If artifacts is nonempty, it is the run's
+// -artifacts directory, which is created so that the command can save
+// files there.
+func runDiagnose(command string, id int64, pid int, tmpdir, artifacts string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(),
+		"FLAKE_RUN_ID="+strconv.FormatInt(id, 10),
+		"FLAKE_PID="+strconv.Itoa(pid),
+	)
+	if flakerun.ProcessGroups {
+		cmd.Env = append(cmd.Env, "FLAKE_PGID="+strconv.Itoa(pid))
+	}
+	if tmpdir != "" {
+		cmd.Env = append(cmd.Env, "FLAKEDIR="+tmpdir)
+	}
+	if artifacts != "" {
+		if err := os.MkdirAll(artifacts, 0o755); err != nil {
+			return fmt.Appendf(nil, "(cannot create artifacts directory: %s)\n", err)
+		}
+		cmd.Env = append(cmd.Env, "FLAKE_ARTIFACTS="+artifacts)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = fmt.Appendf(out, "(%s)\n", err)
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// hangQuitWait is how long -auto-escalate gives a hung run to print its
+// goroutines after SIGQUIT before flake kills it.
+const hangQuitWait = 5 * time.Second
+
+var (
+	// Go's fatal errors for unsynchronized map access, which the race
+	// detector would usually explain.
+	concurrentMapRx = regexp.MustCompile(`(?m)^fatal error: concurrent map`)
+	// Crashes of Go programs (which exit with status 2).
+	crashRx = regexp.MustCompile(`(?m)^(fatal error: |unexpected fault address |\[signal SIG)`)
+)
+
+// classifyFailure returns the class of failure that err (a *runError) is,
+// for -auto-escalate: "hang", "race", "crash", or "" for other failures.
+func classifyFailure(err error) string {
+	re, ok := err.(*runError)
+	if !ok {
+		return ""
+	}
+	if strings.HasPrefix(re.reason, "hang:") || strings.HasPrefix(re.reason, "likely deadlock:") {
+		return "hang"
+	}
+	if concurrentMapRx.Match(re.output) {
+		return "race"
+	}
+	if status, ok := re.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		switch status.Signal() {
+		case syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGABRT, syscall.SIGILL, syscall.SIGFPE:
+			return "crash"
+		}
+	}
+	if crashRx.Match(re.output) {
+		return "crash"
+	}
+	return ""
+}
+
+// diagnostics describe how -auto-escalate runs the command after the first
+// failure to gather evidence about failures of its class.
+type diagnostics struct {
+	cmd       *command
+	quitHangs bool   // send SIGQUIT to hung runs before killing them
+	desc      string // for the log
+}
+
+// chooseDiagnostics returns the diagnostics for failures of class, which
+// classifyFailure returned for a run of c, or nil if flake has nothing more
+// to offer.
+func chooseDiagnostics(c *command, class string) *diagnostics {
+	switch class {
+	case "hang":
+		if quitSignal == nil {
+			return nil
+		}
+		return &diagnostics{
+			cmd:       c.escalate([]string{"GOTRACEBACK=all"}),
+			quitHangs: true,
+			desc:      "SIGQUIT for hung runs before killing them, so that Go programs print all goroutines",
+		}
+	case "race":
+		if slices.Contains(c.args, "-race") {
+			return nil
+		}
+		variants, err := raceVariants(c)
+		if err != nil {
+			return nil
+		}
+		race := variants[0].cmd
+		race.dir = c.dir
+		return &diagnostics{cmd: race, desc: "the race detector (-race), to explain the concurrent map access"}
+	case "crash":
+		// Go programs crash with a core dump with GOTRACEBACK=crash if
+		// the limit allows it.
+		var wrapper []string
+		if runtime.GOOS != "windows" {
+			wrapper = []string{"sh", "-c", `ulimit -c unlimited 2>/dev/null; exec "$@"`, "sh"}
+		}
+		return &diagnostics{
+			cmd:  c.escalate([]string{"GOTRACEBACK=crash"}).wrap(wrapper),
+			desc: "GOTRACEBACK=crash and core dumps (written where the system's core_pattern says)",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// diffFlags returns the flag set of flake diff, which has only a usage
+// message.
+func diffFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("flake diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake diff <run dir> <run dir>
+
+Flake diff compares the artifacts that flake -artifacts saved for two failing
+runs (such as flake-123/run-7), to help decide whether they are the same bug:
+their failure signatures, status, durations, and environments, a diff of their
+outputs, and which of their other files differ. Numbers, addresses, and each
+run's $FLAKEDIR are normalized first, so that only differences that matter
+stand out.
+`)
+	}
+	return fs
+}
+
+func diffMain(args []string) {
+	fs := diffFlags()
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var runs [2]*savedRun
+	for i, dir := range fs.Args() {
+		r, err := readSavedRun(dir)
+		if err != nil {
+			log.Fatalln("Cannot read artifacts:", err)
+		}
+		runs[i] = r
+	}
+	writeRunDiff(os.Stdout, runs[0], runs[1])
+}
+
+// A savedRun is the artifacts of a failing run, normalized for flake diff.
+type savedRun struct {
+	name      string
+	signature string
+	status    map[string]string // from status.txt
+	env       map[string]string
+	output    []string
+	files     map[string]string // the other files
+}
+
+func readSavedRun(dir string) (*savedRun, error) {
+	r := &savedRun{
+		name:  filepath.Base(filepath.Clean(dir)),
+		env:   make(map[string]string),
+		files: make(map[string]string),
+	}
+	var env, output []byte
+	err := readArtifacts(dir, func(name string, data []byte) error {
+		switch name {
+		case "status.txt":
+			r.status = statusFields(data)
+		case "env.txt":
+			env = data
+		case "output.txt":
+			output = data
+		default:
+			r.files[name] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var flakedir string
+	for _, v := range strings.Split(string(env), "\n") {
+		if name, value, ok := strings.Cut(v, "="); ok {
+			r.env[name] = value
+			if name == "FLAKEDIR" {
+				flakedir = value
+			}
+		}
+	}
+	normalize := func(s string) string {
+		if flakedir != "" {
+			s = strings.ReplaceAll(s, flakedir, "$FLAKEDIR")
+		}
+		s = hexRx.ReplaceAllString(s, "0x?")
+		return numberRx.ReplaceAllString(s, "N")
+	}
+	for name, value := range r.env {
+		if flakedir != "" {
+			r.env[name] = strings.ReplaceAll(value, flakedir, "$FLAKEDIR")
+		}
+	}
+	r.output = strings.Split(strings.TrimSuffix(normalize(string(output)), "\n"), "\n")
+	for name, data := range r.files {
+		r.files[name] = normalize(data)
+	}
+	r.signature = outputSignature(r.status["error"], output)
+	return r, nil
+}
+
+// writeRunDiff writes what differs between the saved runs a and b.
+func writeRunDiff(w io.Writer, a, b *savedRun) {
+	fmt.Fprintf(w, "Comparing %s (-) with %s (+)\n", a.name, b.name)
+	if a.signature == b.signature {
+		fmt.Fprintf(w, "Same signature: %s\n", a.signature)
+	} else {
+		fmt.Fprintf(w, "Different signatures:\n  -%s\n  +%s\n", a.signature, b.signature)
+	}
+	fmt.Fprintf(w, "Duration: %s vs %s\n", orDash(a.status["duration"]), orDash(b.status["duration"]))
+
+	var lines []string
+	for _, k := range sortedUnion(a.status, b.status) {
+		if k != "duration" && a.status[k] != b.status[k] {
+			lines = append(lines, fmt.Sprintf("%s: %s -> %s", k, orDash(a.status[k]), orDash(b.status[k])))
+		}
+	}
+	writeDiffSection(w, "Status", lines)
+
+	lines = nil
+	for _, k := range sortedUnion(a.env, b.env) {
+		va, inA := a.env[k]
+		vb, inB := b.env[k]
+		switch {
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+%s=%s", k, vb))
+		case !inB:
+			lines = append(lines, fmt.Sprintf("-%s=%s", k, va))
+		case va != vb:
+			lines = append(lines, fmt.Sprintf("-%s=%s", k, va), fmt.Sprintf("+%s=%s", k, vb))
+		}
+	}
+	writeDiffSection(w, "Environment", lines)
+
+	writeDiffSection(w, "Output", diffContext(diffLines(a.output, b.output), 3))
+
+	lines = nil
+	for _, name := range sortedUnion(a.files, b.files) {
+		da, inA := a.files[name]
+		db, inB := b.files[name]
+		switch {
+		case !inA:
+			lines = append(lines, fmt.Sprintf("%s: only in %s", name, b.name))
+		case !inB:
+			lines = append(lines, fmt.Sprintf("%s: only in %s", name, a.name))
+		case da != db:
+			lines = append(lines, fmt.Sprintf("%s: differs", name))
+		}
+	}
+	writeDiffSection(w, "Other files", lines)
+}
+
+func writeDiffSection(w io.Writer, title string, lines []string) {
+	if len(lines) == 0 {
+		fmt.Fprintf(w, "%s: same\n", title)
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, line := range lines {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
+
+// sortedUnion returns the keys of a and b, sorted.
+func sortedUnion[V any](a, b map[string]V) []string {
+	keys := slices.Collect(maps.Keys(a))
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// maxDiffCells limits the work diffLines does to match up lines: if the
+// stretches of a and b between their common prefix and suffix are longer
+// than this together (multiplied), all of a's is shown as removed and all of
+// b's as added.
+const maxDiffCells = 1 << 22
+
+// diffLines returns the lines of a and b as an edit script that turns a into
+// b: each line is prefixed by ' ' if it is in both, '-' if it is only in a,
+// or '+' if it is only in b.
+func diffLines(a, b []string) []string {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var script []string
+	for _, line := range a[:prefix] {
+		script = append(script, " "+line)
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > maxDiffCells {
+		for _, line := range ma {
+			script = append(script, "-"+line)
+		}
+		for _, line := range mb {
+			script = append(script, "+"+line)
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of
+		// ma[i:] and mb[j:].
+		lcs := make([][]int32, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) || j < len(mb) {
+			switch {
+			case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+				script = append(script, " "+ma[i])
+				i++
+				j++
+			case j == len(mb) || i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]:
+				script = append(script, "-"+ma[i])
+				i++
+			default:
+				script = append(script, "+"+mb[j])
+				j++
+			}
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		script = append(script, " "+line)
+	}
+	return script
+}
+
+// diffContext returns the changed lines of an edit script from diffLines
+// with up to n unchanged lines around them, and "..." for the lines left
+// out. It returns nil if nothing changed.
+func diffContext(script []string, n int) []string {
+	keep := make([]bool, len(script))
+	for i, line := range script {
+		if line[0] != ' ' {
+			for j := max(0, i-n); j <= min(len(script)-1, i+n); j++ {
+				keep[j] = true
+			}
+		}
+	}
+	if !slices.Contains(keep, true) {
+		return nil
+	}
+	var lines []string
+	skipped := false
+	for i, line := range script {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			lines = append(lines, "...")
+			skipped = false
+		}
+		lines = append(lines, line)
+	}
+	if skipped {
+		lines = append(lines, "...")
+	}
+	return lines
+}
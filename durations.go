@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// maxDurationSample bounds the memory used to remember run durations.
+const maxDurationSample = 10000
+
+// A durationSample is a uniform random sample (a reservoir) of the durations
+// of the successful runs of a session.
+type durationSample struct {
+	n      int64
+	sample []time.Duration
+}
+
+func (s *durationSample) add(d time.Duration) {
+	s.n++
+	if len(s.sample) < maxDurationSample {
+		s.sample = append(s.sample, d)
+		return
+	}
+	if i := rand.Int64N(s.n); i < maxDurationSample {
+		s.sample[i] = d
+	}
+}
+
+// minDurationSample is the number of successful runs needed to say anything
+// about how failing runs' durations compare.
+const minDurationSample = 20
+
+// analyzeDurations compares the durations of failing runs against the
+// successful runs in passing and describes whether failures correlate with
+// unusually slow or fast runs. It returns "" if there is too little data.
+func analyzeDurations(passing *durationSample, failing []time.Duration) string {
+	if len(passing.sample) < minDurationSample || len(failing) == 0 {
+		return ""
+	}
+	sorted := slices.Clone(passing.sample)
+	slices.Sort(sorted)
+	// Under the hypothesis that failures are unrelated to duration, each
+	// failure's percentile among passing runs is uniform on [0, 1], so
+	// their mean has a standard deviation of sqrt(1/(12k)).
+	var sum float64
+	for _, d := range failing {
+		i, _ := slices.BinarySearch(sorted, d)
+		sum += float64(i) / float64(len(sorted))
+	}
+	k := float64(len(failing))
+	mean := sum / k
+	threshold := min(2*math.Sqrt(1/(12*k)), 0.49)
+
+	msg := fmt.Sprintf("Failing runs took %s (median of %d); passing runs took %s (median of %d).\n",
+		median(failing), len(failing), sorted[len(sorted)/2], passing.n)
+	msg += fmt.Sprintf("On average, failing runs were slower than %.0f%% of passing runs: ", 100*mean)
+	switch {
+	case mean >= 0.5+threshold:
+		msg += "failures correlate with unusually slow runs, which suggests a timeout or a slow path."
+	case mean <= 0.5-threshold:
+		msg += "failures correlate with unusually fast runs, which suggests an early exit."
+	default:
+		msg += "failures do not correlate with run duration, which suggests a race rather than a timeout."
+	}
+	return msg
+}
+
+func median(ds []time.Duration) time.Duration {
+	sorted := slices.Clone(ds)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// numRecentDurations is how many of the latest runs the progress histogram
+// shows.
+const numRecentDurations = 100
+
+// recentDurations holds the durations of the latest runs in a ring buffer.
+type recentDurations struct {
+	ds [numRecentDurations]time.Duration
+	n  int
+}
+
+func (r *recentDurations) add(d time.Duration) {
+	r.ds[r.n%len(r.ds)] = d
+	r.n++
+}
+
+var histogramBars = []rune(" ▁▂▃▄▅▆▇█")
+
+const (
+	histogramBuckets = 24
+	minHistogram     = 10 // runs
+)
+
+// histogram renders the recent durations as a one-line histogram between the
+// shortest and the longest of them, or returns "" if there are too few.
+func (r *recentDurations) histogram() string {
+	ds := r.ds[:min(r.n, len(r.ds))]
+	if len(ds) < minHistogram {
+		return ""
+	}
+	lo, hi := slices.Min(ds), slices.Max(ds)
+	var counts [histogramBuckets]int
+	for _, d := range ds {
+		counts[int64(d-lo)*histogramBuckets/int64(hi-lo+1)]++
+	}
+	peak := slices.Max(counts[:])
+	bars := make([]rune, len(counts))
+	for i, c := range counts {
+		// Any nonempty bucket gets at least the smallest bar.
+		bars[i] = histogramBars[(c*(len(histogramBars)-1)+peak-1)/peak]
+	}
+	round := func(d time.Duration) time.Duration {
+		if d < time.Millisecond {
+			return d.Round(time.Microsecond)
+		}
+		return d.Round(time.Millisecond)
+	}
+	return fmt.Sprintf("last %d runs: %s %s %s", len(ds), round(lo), string(bars), round(hi))
+}
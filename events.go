@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxEventOutput is how much of a failed run's output (the end of it) is
+// included in its -json event.
+const maxEventOutput = 4096
+
+// A jsonEvent is one line of -json output.
+type jsonEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"` // start, finish, or end
+	Run    int64     `json:"run,omitempty"`
+	Worker int       `json:"worker,omitempty"`
+
+	// For finish events:
+	Elapsed    float64 `json:"elapsed,omitempty"` // seconds
+	Result     string  `json:"result,omitempty"`  // pass, fail, unconfirmed, ignored, error, or cancelled
+	ExitStatus *int    `json:"exit_status,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Output     string  `json:"output,omitempty"`     // truncated
+	ClockJump  float64 `json:"clock_jump,omitempty"` // seconds
+
+	// For the end event:
+	Passed   int64  `json:"passed,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	Code     string `json:"code,omitempty"`         // git state
+	Seed     uint64 `json:"session_seed,omitempty"` // if flake made random choices
+}
+
+// An eventStream writes -json events as newline-delimited JSON. Every run
+// that starts also finishes: runs still in progress when the session ends
+// finish as cancelled.
+type eventStream struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	running map[int64]*jsonEvent // start events of the unfinished runs
+}
+
+func newEventStream(w io.Writer) *eventStream {
+	return &eventStream{enc: json.NewEncoder(w), running: make(map[int64]*jsonEvent)}
+}
+
+func (s *eventStream) emit(ev *jsonEvent) {
+	ev.Time = time.Now()
+	s.mu.Lock()
+	switch ev.Event {
+	case "start":
+		s.running[ev.Run] = ev
+	case "finish":
+		delete(s.running, ev.Run)
+	}
+	s.enc.Encode(ev)
+	s.mu.Unlock()
+}
+
+func (s *eventStream) start(id int64, worker int) {
+	s.emit(&jsonEvent{Event: "start", Run: id, Worker: worker})
+}
+
+func (s *eventStream) finish(r runResult) {
+	ev := &jsonEvent{
+		Event:     "finish",
+		Run:       r.id,
+		Worker:    r.worker,
+		Elapsed:   r.elapsed.Seconds(),
+		Result:    "pass",
+		ClockJump: r.clockJump.Seconds(),
+	}
+	err := r.err
+	if r.unconfirmed != nil {
+		ev.Result = "unconfirmed"
+		err = r.unconfirmed
+	}
+	if r.ignored != nil {
+		ev.Result = "ignored"
+		err = r.ignored
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		if re, ok := err.(*runError); ok {
+			if ev.Result == "pass" {
+				ev.Result = "fail"
+			}
+			status := re.state.ExitCode()
+			ev.ExitStatus = &status
+			out := re.output
+			if len(out) > maxEventOutput {
+				out = out[len(out)-maxEventOutput:]
+			}
+			ev.Output = string(out)
+		} else {
+			ev.Result = "error"
+		}
+	} else {
+		status := 0
+		ev.ExitStatus = &status
+	}
+	s.emit(ev)
+}
+
+func (s *eventStream) end(passed int64, failures int, code *gitState, seed uint64) {
+	s.mu.Lock()
+	var cancelled []*jsonEvent
+	for _, start := range s.running {
+		cancelled = append(cancelled, start)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(cancelled, func(a, b *jsonEvent) int { return cmp.Compare(a.Run, b.Run) })
+	for _, start := range cancelled {
+		s.emit(&jsonEvent{
+			Event:   "finish",
+			Run:     start.Run,
+			Worker:  start.Worker,
+			Elapsed: time.Since(start.Time).Seconds(),
+			Result:  "cancelled",
+		})
+	}
+	ev := &jsonEvent{Event: "end", Passed: passed, Failures: failures, Seed: seed}
+	if code != nil {
+		ev.Code = code.String()
+	}
+	s.emit(ev)
+}
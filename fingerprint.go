@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// fingerprintInterval is how often flake checks whether the programs that the
+// runs use have changed.
+const fingerprintInterval = 10 * time.Second
+
+// fingerprintEnv lists the environment variables that are recorded in an
+// envFingerprint because they change how programs (especially Go programs
+// and the go tool) behave.
+var fingerprintEnv = []string{
+	"CGO_ENABLED", "GOARCH", "GODEBUG", "GOEXPERIMENT", "GOFLAGS",
+	"GOMAXPROCS", "GOOS", "GOTOOLCHAIN",
+}
+
+// An envFingerprint identifies the programs and environment that a session's
+// runs use, so that flake can warn if someone rebuilds the binary under test
+// (or the toolchain) in the middle of a session: mixing runs of different
+// binaries invalidates the statistics.
+type envFingerprint struct {
+	files     []*fileFingerprint // the executable, and the go tool
+	goVersion string
+	env       []string // NAME=value
+}
+
+type fileFingerprint struct {
+	desc    string
+	path    string
+	size    int64
+	modTime time.Time
+	hash    string // hex SHA-256
+}
+
+// newEnvFingerprint fingerprints the environment of runs of the executable
+// at path.
+func newEnvFingerprint(path string) *envFingerprint {
+	fp := new(envFingerprint)
+	if f, err := fingerprintFile("executable", path); err == nil {
+		fp.files = append(fp.files, f)
+	}
+	if goTool, err := exec.LookPath("go"); err == nil {
+		if goTool != path {
+			if f, err := fingerprintFile("go tool", goTool); err == nil {
+				fp.files = append(fp.files, f)
+			}
+		}
+		if out, err := exec.Command(goTool, "env", "GOVERSION").Output(); err == nil {
+			fp.goVersion = strings.TrimSpace(string(out))
+		}
+	}
+	for _, name := range fingerprintEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			fp.env = append(fp.env, name+"="+v)
+		}
+	}
+	return fp
+}
+
+func fingerprintFile(desc, path string) (*fileFingerprint, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileFingerprint{desc: desc, path: path, size: fi.Size(), modTime: fi.ModTime(), hash: hash}, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (fp *envFingerprint) String() string {
+	var parts []string
+	for _, f := range fp.files {
+		parts = append(parts, fmt.Sprintf("%s %s (sha256 %.12s)", f.desc, f.path, f.hash))
+	}
+	if fp.goVersion != "" {
+		parts = append(parts, fp.goVersion)
+	}
+	parts = append(parts, fp.env...)
+	return strings.Join(parts, ", ")
+}
+
+// changes describes how the files have changed since the fingerprint was
+// taken (or since the last call). It only hashes files whose size or
+// modification time changed.
+func (fp *envFingerprint) changes() []string {
+	var changes []string
+	for _, f := range fp.files {
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			if f.hash != "" {
+				changes = append(changes, fmt.Sprintf("the %s %s was removed", f.desc, f.path))
+				f.hash = ""
+			}
+			continue
+		}
+		if fi.Size() == f.size && fi.ModTime().Equal(f.modTime) {
+			continue
+		}
+		f.size, f.modTime = fi.Size(), fi.ModTime()
+		hash, err := hashFile(f.path)
+		if err != nil || hash == f.hash {
+			continue
+		}
+		if f.hash == "" {
+			changes = append(changes, fmt.Sprintf("the %s %s was replaced (sha256 %.12s)", f.desc, f.path, hash))
+		} else {
+			changes = append(changes, fmt.Sprintf("the %s %s changed (sha256 %.12s, was %.12s)", f.desc, f.path, hash, f.hash))
+		}
+		f.hash = hash
+	}
+	return changes
+}
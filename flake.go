@@ -3,189 +3,2368 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
-	"golang.org/x/sys/unix"
+	"github.com/cespare/flake/flakerun"
 	"golang.org/x/term"
 )
 
-var stdoutIsTTY bool
+// reportFailures reports multiple failures collected with -failures, each
+// using reportDetails.
+func reportFailures(failures []runResult, n int64, reportDetails func(error)) {
+	log.Printf("Collected %d failure(s) and %d successful iteration(s):", len(failures), n)
+	for i, r := range failures {
+		log.Printf("Failure %d of %d (run %d):", i+1, len(failures), r.id)
+		reportDetails(r.err)
+	}
+}
+
+// exitFailed is flake's exit status when a run fails.
+const exitFailed = 3
+
+// cpuLimitEnv is set, to the -cpu-limit, in the environment of a flake
+// process that limits its CPU time and then executes a run's command (see
+// cpuLimitExec).
+const cpuLimitEnv = "FLAKE_CPU_LIMIT_EXEC"
 
-func init() {
-	stdoutIsTTY = term.IsTerminal(int(os.Stdout.Fd()))
+// Progress goes to progressOut: stdout, or stderr with -progress-stderr.
+var (
+	progressOut *os.File = os.Stdout
+	progressTTY bool
+	progressVT  bool // the terminal handles escape sequences
+)
+
+// setProgressOut sends progress to f.
+func setProgressOut(f *os.File) {
+	progressOut = f
+	progressTTY = term.IsTerminal(int(f.Fd()))
+	progressVT = progressTTY && enableVT(f)
 }
 
 func main() {
 	log.SetFlags(0)
+	setProgressOut(os.Stdout)
 
-	tmpdir := flag.String("tmpdir", "", "Create a tmpdir here for each run ($FLAKEDIR)")
+	if limit := os.Getenv(cpuLimitEnv); limit != "" {
+		cpuLimitExec(limit, os.Args[1:])
+	}
+	if spec := os.Getenv(seccompEnv); spec != "" {
+		seccompExec(spec, os.Args[1:])
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "triage" {
+		triageMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "order" {
+		orderMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bisect" {
+		bisectMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		historyMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bundle" {
+		bundleMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diffMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		reportMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge-report" {
+		mergeReportMain(os.Args[2:])
+		return
+	}
+
+	tmpdir := flag.String("tmpdir", "", "Create a tmpdir here for each run ($FLAKEDIR) and one for\neach worker that persists across its runs ($FLAKE_WORKER_DIR);\nthe failing run's tmpdir is kept (or, with -artifacts, moved to\nits artifacts)")
+	privateTmp := flag.Bool("private-tmp", false, "Also point $TMPDIR, $TMP, and $TEMP at each run's tmpdir\n(implies -tmpdir, using the system temp dir if unset)")
 	parallelism := flag.Int("p", runtime.GOMAXPROCS(0), "Run this many processes in parallel")
+	targetCPU := flag.String("target-cpu", "", "Adjust the number of parallel runs (up to -p) to hold\nsystem CPU utilization near this percentage")
+	cpuLimit := flag.Duration("cpu-limit", 0, "Kill any process of a run that uses more than this much\nCPU time and report it as a CPU runaway")
+	timeout := flag.Duration("timeout", 0, "Kill a run that takes longer than this and report it as a hang;\nthe run gets the time it will be killed as $FLAKE_DEADLINE (RFC 3339)\nand this budget as $FLAKE_TIMEOUT")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Kill a run whose processes use no CPU and write no output\nfor this long and report it as a likely deadlock")
+	grace := flag.Duration("grace", 0, "When flake kills a run (at a timeout, or when the session\nends), send its processes SIGTERM and wait this long before\nsending SIGKILL, so that they can flush logs and clean up")
+	heartbeat := flag.Duration("heartbeat", 0, "Set $FLAKE_HEARTBEAT to a file that each run must touch at\nleast this often, and kill a run whose heartbeat goes stale\nand report it as a hang (see README)")
+	goleak := flag.Bool("goleak", false, "Treat runs that report leaked goroutines (as goleak does)\nas failures even if they exit successfully")
+	untilSuccess := flag.Bool("until-success", false, "Invert the meaning of runs: keep going through failures and\nstop at the first run that succeeds, printing its output (and\nexiting with status 3, as for a failure without this flag)")
+	ignoreRegexp := flag.String("ignore-regexp", "", "Count failures whose output matches this regular expression\n(such as known, irrelevant errors) but otherwise ignore them")
+	failRegexp := flag.String("fail-regexp", "", "Treat a run as failed if its output (stdout and stderr)\nmatches this regular expression, whatever its exit status")
+	escalate := flag.String("escalate", "", "After the first failure, report it and keep going with these\nextra arguments (leading NAME=value words set environment\nvariables instead), e.g. -escalate 'GOTRACEBACK=all -v'")
+	autoEscalate := flag.Bool("auto-escalate", false, "Like -escalate, but choose diagnostics by how the first run\nfailed: hung runs get SIGQUIT (for goroutine dumps) before they\nare killed, crashes get GOTRACEBACK=crash and core dumps, and\nconcurrent map errors in go test get -race")
+	instrument := flag.String("instrument", "", "After a failure, rerun the failing command under this\nwrapper (such as 'strace -f -o $FLAKEDIR/trace') to try to\nreproduce it with more evidence; $FLAKEDIR is expanded")
+	instrumentRuns := flag.Int("instrument-runs", 10, "Make at most this many attempts with -instrument")
+	sysState := flag.Bool("sysstate", false, "When a run fails, save a snapshot of the system state\n(processes, sockets, disk, memory, kernel log)")
+	diagnose := flag.String("diagnose", "", "When a run fails (or is about to be killed), run this shell\ncommand with $FLAKE_RUN_ID, $FLAKE_PID, $FLAKE_PGID, $FLAKEDIR,\nand $FLAKE_ARTIFACTS (the run's -artifacts directory) set and\nreport its output")
+	fixtureDir := flag.String("fixture-dir", "", "Assign each run one file from this directory, in turn,\nas $FLAKE_FIXTURE")
+	fixtureRandom := flag.Bool("fixture-random", false, "Assign -fixture-dir files at random rather than in turn")
+	traceFile := flag.String("trace", "", "Write a timeline of the session's runs to this file in\nTrace Event Format (for Perfetto or chrome://tracing)")
+	numa := flag.Bool("numa", false, "Bind each worker's runs to a NUMA node (CPUs and memory),\nassigning nodes to workers in turn; requires numactl")
+	privateMounts := flag.Bool("private-mounts", false, "Run each iteration in a private mount namespace with a\nfresh tmpfs on /tmp; requires unshare (Linux) and, when not\nroot, user namespaces (runs then see themselves as root)")
+	runLog := flag.String("run-log-template", "", "Also write each run's output, as it is produced, to the file\nnamed by this template, e.g. 'logs/run-{{.ID}}.log'\n(fields: .ID, .Worker)")
+	chaos := flag.Duration("chaos", 0, "Give each run a random chaos level up to this duration as\n$FLAKE_CHAOS, for test helpers to sleep randomly up to that\nlong at instrumented points (see README)")
+	chaosLevel := flag.Duration("chaos-level", 0, "Like -chaos, but give every run exactly this chaos level\n(to replay the level of a failing run)")
+	sessionSeed := flag.Uint64("session-seed", 0, "Derive flake's own random choices for each run (-fixture-random\nfiles, -chaos levels, -seccomp fractions, and -proxy faults) from\nthis seed and the run's number, to reproduce a session's schedule;\nby default, flake chooses a seed and reports it")
+	seccompSpec := flag.String("seccomp", "", "Make system calls fail in runs, using a seccomp filter (Linux),\nas a comma-separated list of syscall=ERRNO, such as 'fsync=EIO';\nwith @fraction (as in 'connect=ECONNREFUSED@0.1'), a rule only\napplies to that fraction of runs, chosen at random")
+	proxySpec := flag.String("proxy", "", "Point each run at its own HTTP proxy ($HTTP_PROXY and\n$HTTPS_PROXY) that injects faults into requests with these\nprobabilities, e.g. 'reset=1%,5xx=2%,delay=5%': reset closes\nthe connection, 5xx responds 503, and delay waits -proxy-delay")
+	proxyDelay := flag.Duration("proxy-delay", time.Second, "The delay that -proxy injects")
+	clockSkew := flag.Duration("clock-skew", 0, "Run each worker with a different clock offset, spread from\nminus to plus this duration, to find code that compares times\nfrom concurrent components; requires faketime, which does not\naffect Go programs (they do not read the time through libc)")
+	followWorker := flag.Int("follow", 0, "Print the output of worker N's runs as they run, each line\nstarting with the run's ID, while the other workers run silently")
+	timestamps := flag.Bool("timestamps", false, "Also record each run's stdout and stderr separately, with each\nline stamped with the time since the run started, and report a\nfailing run's output that way (with the stream of each line)")
+	usePTY := flag.Bool("pty", false, "Run each iteration with a pseudo-terminal as its standard\ninput, output, and error (Linux), for programs that behave\ndifferently when they are not run in a terminal")
+	confirm := flag.Int("confirm", 0, "When a run fails, rerun the same configuration up to this\nmany times and ignore the failure unless a rerun also fails")
+	var maxOutput byteSize
+	flag.Var(&maxOutput, "max-output", "Keep at most this much of each run's output in memory (such as\n1MB), keeping the start and the end; by default, all of it")
+	onlyWhenIdle := flag.Bool("only-when-idle", false, "Only start runs while nobody is using the machine: while there\nhas been no terminal input for -idle-after (and, with -idle-load,\nwhile other processes are not busy)")
+	idleAfter := flag.Duration("idle-after", 5*time.Minute, "How long after the last terminal input the machine counts as\nidle for -only-when-idle")
+	idleLoad := flag.Float64("idle-load", 0, "With -only-when-idle, also hold runs back while the 1-minute load\naverage, less flake's own runs, is above this")
+	var minFreeMem byteSize
+	flag.Var(&minFreeMem, "min-free-mem", "Delay starting runs while less than this much memory would\nremain available, allowing for the largest run seen so far")
+	maxFailures := flag.Int("failures", 1, "Keep going after failures until this many have been\ncollected, then report them grouped by how they failed")
+	similarity := flag.Float64("similarity", defaultSimilarity, "In the summary of failures, show signatures that are at least\nthis similar (from 0 to 1, by the pairs of words they share)\ntogether; 0 shows each signature on its own")
+	cacheExperiment := flag.Bool("cache-experiment", false, "Alternate runs between empty (cold) build caches ($GOCACHE\nand $XDG_CACHE_HOME) and the existing (warm) ones, keep going\nthrough failures, and compare the failure rates")
+	gotest := flag.Bool("gotest", false, "For a 'go test' command, run it with -json and report which\ntests failed, each with its own output and duration")
+	compileTest := flag.Bool("compile-test", false, "For a 'go test' command of one package, build the test\nbinary once with 'go test -c' and run it directly\n(with -state, the binary is kept next to the state file)")
+	narrow := flag.Int64("narrow", 0, "After a 'go test' run fails, rerun just the failing test (with\n-run) this many times and compare its failure rate in isolation\nwith the rate in the full package")
+	raceExperiment := flag.Bool("race-experiment", false, "For a 'go test' command, alternate runs between the command\nwith and without -race, keep going through failures, and\ncompare the failure rates")
+	compare := flag.String("compare", "", "Alternate runs between the command (A) and this shell command\n(B), such as the same test with a candidate fix, keep going\nthrough failures, and compare the failure rates")
+	gateSpec := flag.String("gate", "", "Keep going through failures and, at the end of the budget\n(-max-runs, -max-time, or -until), pass only if the failure\nrate is below a limit with some confidence, e.g. 'rate<0.5% @ 95%'")
+	excludeJumps := flag.Bool("exclude-clock-jumps", false, "Leave runs during which the wall clock jumped (because the\nmachine was suspended or the clock was changed) out of the\nduration statistics")
+	verifyRate := flag.String("verify", "", "Keep running until the failure rate is below this rate (such\nas 0.001 or 0.1%) with -verify-confidence, or until a run fails")
+	verifyConfidence := flag.String("verify-confidence", "95%", "The confidence level for -verify")
+	maxTime := flag.Duration("max-time", 0, "Stop after running for this long")
+	maxRuns := flag.Int64("max-runs", 0, "Stop after this many iterations, passed or failed")
+	until := flag.String("until", "", "Stop at this time of day (15:04 or 15:04:05) or RFC 3339 time")
+	state := flag.String("state", "", "Record the configuration of every run to this file (or,\nwith -replay-iteration, read it)")
+	stdinCommands := flag.Bool("stdin-commands", false, "Instead of running a command, read shell commands from stdin,\none per line, and split the budget (-max-runs, -max-time, or\n-until) between them like flake triage; other flags but -p are\nignored")
+	replayIteration := flag.Int64("replay-iteration", 0, "Instead of running a command, rerun this iteration of the\nsession recorded with -state and report whether it fails")
+	var artifactLimit byteSize
+	flag.Var(&artifactLimit, "artifact-budget", "With -artifacts, delete the artifacts of the oldest failing runs\nto keep the total size under this")
+	artifacts := flag.String("artifacts", "", "Save the output, status, environment, and tmpdir contents\nof every failing run in a subdirectory of this directory")
+	compressArtifacts := flag.Bool("compress-artifacts", false, "With -artifacts, gzip every saved file (as <file>.gz)")
+	junit := flag.String("junit", "", "Write a JUnit XML report of the session to this file")
+	quiet := flag.Bool("quiet", false, "Don't show progress while running (failures and the summary\nare still printed)")
+	progressStderr := flag.Bool("progress-stderr", false, "Show progress (and -v lines) on stderr rather than stdout, so\nthat stdout only has -json events or -follow output")
+	verbose := flag.Bool("v", false, "Print a line for each run as it finishes, with its ID, worker,\nduration, and exit status")
+	jsonOut := flag.Bool("json", false, "Instead of showing progress, write an event to stdout as each\nrun starts and finishes, as newline-delimited JSON")
+	dryRun := flag.Bool("dry-run", false, "Print what would be run and exit")
+	completion := flag.String("completion", "", "Print a completion script for this shell (bash, zsh, or fish)")
 	flag.Usage = usage
 	flag.Parse()
 
+	if *completion != "" {
+		if err := writeCompletion(os.Stdout, *completion); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if *parallelism < 1 {
 		log.Fatalln("-p must be positive")
 	}
-	if flag.NArg() < 1 {
-		usage()
-		os.Exit(2)
+	if *instrumentRuns < 1 {
+		log.Fatalln("-instrument-runs must be positive")
+	}
+	if *narrow < 0 {
+		log.Fatalln("-narrow must not be negative")
+	}
+	if *chaos < 0 || *chaosLevel < 0 {
+		log.Fatalln("-chaos and -chaos-level must not be negative")
+	}
+	if *chaos > 0 && *chaosLevel > 0 {
+		log.Fatalln("Cannot use both -chaos and -chaos-level")
+	}
+	if *usePTY && !ptySupported {
+		log.Fatalln("-pty is not supported on this platform")
+	}
+	if *followWorker < 0 || *followWorker > *parallelism {
+		log.Fatalln("-follow must be a worker number from 1 to -p")
+	}
+	if *progressStderr {
+		setProgressOut(os.Stderr)
+	}
+	if *verbose && *jsonOut && !*progressStderr {
+		log.Fatalln("Cannot use -v with -json")
+	}
+	if *followWorker > 0 && *jsonOut {
+		log.Fatalln("Cannot use -follow with -json")
+	}
+	if *timestamps && (*gotest || *usePTY) {
+		log.Fatalln("Cannot use -timestamps with -gotest or -pty")
+	}
+	var proxyFaults *proxyFaults
+	if *proxySpec != "" {
+		var err error
+		proxyFaults, err = parseProxyFaults(*proxySpec)
+		if err != nil {
+			log.Fatalln("Bad -proxy:", err)
+		}
+	}
+	if *proxyDelay <= 0 {
+		log.Fatalln("-proxy-delay must be positive")
+	}
+	var seccompRules []seccompRule
+	if *seccompSpec != "" {
+		if !seccompSupported {
+			log.Fatalln("-seccomp is not supported on this platform")
+		}
+		var err error
+		seccompRules, err = parseSeccompRules(*seccompSpec)
+		if err != nil {
+			log.Fatalln("Bad -seccomp:", err)
+		}
+	}
+	if *maxFailures < 1 {
+		log.Fatalln("-failures must be positive")
+	}
+	if *similarity < 0 || *similarity > 1 {
+		log.Fatalln("-similarity must be between 0 and 1")
+	}
+	if *maxTime < 0 {
+		log.Fatalln("-max-time must not be negative")
+	}
+	if *maxRuns < 0 {
+		log.Fatalln("-max-runs must not be negative")
+	}
+	if *confirm < 0 {
+		log.Fatalln("-confirm must not be negative")
+	}
+	var replay *stateRecord
+	if *replayIteration > 0 {
+		if *state == "" {
+			log.Fatalln("-replay-iteration requires -state")
+		}
+		if flag.NArg() > 0 {
+			log.Fatalln("-replay-iteration reruns a recorded command; do not give one")
+		}
+		var err error
+		if replay, err = readStateRecord(*state, *replayIteration); err != nil {
+			log.Fatalln("Cannot replay:", err)
+		}
+	} else if *stdinCommands {
+		if flag.NArg() > 0 {
+			log.Fatalln("-stdin-commands reads the commands from stdin; do not give one")
+		}
+	} else if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Exit with a nonzero status once the deferred cleanup is done.
+	var exitStatus int
+	defer func() {
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+	}()
+
+	var slo *failureGate
+	if *gateSpec != "" {
+		var err error
+		if slo, err = parseFailureGate(*gateSpec); err != nil {
+			log.Fatalln("Bad -gate:", err)
+		}
+		if *maxRuns == 0 && *maxTime == 0 && *until == "" {
+			log.Fatalln("-gate requires a budget: -max-runs, -max-time, or -until")
+		}
+		if *escalate != "" {
+			log.Fatalln("Cannot use both -gate and -escalate")
+		}
+	}
+
+	var verify *failureGate
+	if *verifyRate != "" {
+		var err error
+		if verify, err = parseVerify(*verifyRate, *verifyConfidence); err != nil {
+			log.Fatalln("Bad -verify:", err)
+		}
+		if slo != nil || *cacheExperiment || *raceExperiment || *compare != "" || *maxFailures > 1 || *untilSuccess {
+			log.Fatalln("Cannot use -verify with -gate, -failures, -until-success, -compare, -cache-experiment, or -race-experiment")
+		}
+	}
+
+	if *cacheExperiment && *raceExperiment || *compare != "" && (*cacheExperiment || *raceExperiment) {
+		log.Fatalln("Cannot use more than one of -compare, -cache-experiment, and -race-experiment")
+	}
+	if (*raceExperiment || *compare != "") && *escalate != "" {
+		log.Fatalln("Cannot use -escalate with -race-experiment or -compare")
+	}
+	if *autoEscalate && (*escalate != "" || slo != nil || *raceExperiment || *compare != "") {
+		log.Fatalln("Cannot use -auto-escalate with -escalate, -gate, -race-experiment, or -compare")
+	}
+	// With -gate or an experiment, the failure rate matters more than
+	// the first failure.
+	keepGoing := slo != nil || *cacheExperiment || *raceExperiment || *compare != ""
+
+	var deadline time.Time
+	if *until != "" {
+		var err error
+		deadline, err = parseUntil(*until, time.Now())
+		if err != nil {
+			log.Fatalln("Bad -until:", err)
+		}
+	}
+
+	if *stdinCommands {
+		budget := *maxTime
+		if !deadline.IsZero() && (budget == 0 || time.Until(deadline) < budget) {
+			budget = time.Until(deadline)
+		}
+		if budget == 0 && *maxRuns == 0 {
+			log.Fatalln("-stdin-commands requires a budget: -max-runs, -max-time, or -until")
+		}
+		suspects, err := readSuspects(os.Stdin)
+		if err != nil {
+			log.Fatalln("Cannot read commands:", err)
+		}
+		runTriage(suspects, budget, *maxRuns, *parallelism)
+		return
+	}
+
+	var cpuTarget float64
+	if *targetCPU != "" {
+		var err error
+		cpuTarget, err = parsePercent(*targetCPU)
+		if err != nil {
+			log.Fatalln("Bad -target-cpu:", err)
+		}
+		if _, _, err := cpuTimes(); err != nil {
+			log.Fatalln("Cannot use -target-cpu:", err)
+		}
+	}
+
+	if *sysState && runtime.GOOS == "windows" {
+		log.Fatalln("-sysstate is not supported on Windows")
+	}
+	if *cpuLimit > 0 && !procSupported {
+		log.Fatalln("-cpu-limit is not supported on this platform")
+	}
+	if *idleTimeout > 0 && !procSupported {
+		log.Fatalln("-idle-timeout is not supported on this platform")
+	}
+	if *grace < 0 {
+		log.Fatalln("-grace must not be negative")
+	}
+	if artifactLimit > 0 && *artifacts == "" {
+		log.Fatalln("-artifact-budget requires -artifacts")
+	}
+	if *compressArtifacts && *artifacts == "" {
+		log.Fatalln("-compress-artifacts requires -artifacts")
+	}
+	if *onlyWhenIdle {
+		if _, err := lastTerminalInput(); err != nil {
+			log.Fatalln("Cannot use -only-when-idle:", err)
+		}
+		if *idleAfter <= 0 {
+			log.Fatalln("-idle-after must be positive")
+		}
+		if *idleLoad > 0 {
+			if _, err := loadAverage(); err != nil {
+				log.Fatalln("Cannot use -idle-load:", err)
+			}
+		}
+	}
+	if minFreeMem > 0 {
+		if _, err := memAvailable(); err != nil {
+			log.Fatalln("Cannot use -min-free-mem:", err)
+		}
+	}
+
+	cmd := &command{args: flag.Args()}
+	var replayConfig runConfig
+	if replay != nil {
+		var err error
+		if replayConfig, err = replay.config(); err != nil {
+			log.Fatalln("Cannot replay:", err)
+		}
+		cmd = replayConfig.cmd
+	}
+	if *untilSuccess && (keepGoing || *narrow > 0 || *maxFailures > 1) {
+		log.Fatalln("Cannot use -until-success with -gate, -failures, -narrow, -compare, -cache-experiment, or -race-experiment")
+	}
+	if *narrow > 0 && replay == nil {
+		if _, err := parseGoTest(cmd); err != nil {
+			log.Fatalln("Cannot use -narrow:", err)
+		}
+	}
+	if *gotest && replay == nil {
+		if _, err := parseGoTest(cmd); err != nil {
+			log.Fatalln("Cannot use -gotest:", err)
+		}
+		if !*compileTest {
+			cmd = &command{args: slices.Insert(slices.Clone(cmd.args), 2, "-json")}
+		}
+	}
+	var goTestCmd *goTest
+	if *compileTest {
+		if *raceExperiment || *escalate != "" {
+			log.Fatalln("Cannot use -compile-test with -race-experiment or -escalate")
+		}
+		var err error
+		if goTestCmd, err = parseGoTest(cmd); err != nil {
+			log.Fatalln("Cannot use -compile-test:", err)
+		}
+	}
+	var variants []*variant
+	if *cacheExperiment {
+		variants = cacheVariants
+	}
+	if *raceExperiment {
+		var err error
+		if variants, err = raceVariants(cmd); err != nil {
+			log.Fatalln("Cannot use -race-experiment:", err)
+		}
+	}
+	if *compare != "" {
+		variants = compareVariants(*compare)
+	}
+	var escalated *command
+	if *escalate != "" {
+		escalated = cmd.escalate(strings.Fields(*escalate))
+	}
+
+	var fixtures []string
+	if *fixtureDir != "" {
+		var err error
+		fixtures, err = listFixtures(*fixtureDir)
+		if err != nil {
+			log.Fatalln("Bad -fixture-dir:", err)
+		}
+	}
+
+	var nodes []int
+	if *clockSkew < 0 {
+		log.Fatalln("-clock-skew must not be negative")
+	}
+	if *clockSkew > 0 {
+		if _, err := exec.LookPath("faketime"); err != nil {
+			log.Fatalln("Cannot use -clock-skew:", err)
+		}
+	}
+	if *numa {
+		var err error
+		if nodes, err = numaNodes(); err != nil {
+			log.Fatalln("Cannot use -numa:", err)
+		}
+		if _, err := exec.LookPath("numactl"); err != nil {
+			log.Fatalln("Cannot use -numa:", err)
+		}
+	}
+
+	if *privateMounts {
+		if runtime.GOOS != "linux" {
+			log.Fatalln("-private-mounts is only supported on Linux")
+		}
+		if _, err := exec.LookPath("unshare"); err != nil {
+			log.Fatalln("Cannot use -private-mounts:", err)
+		}
+	}
+
+	var failRx *regexp.Regexp
+	if *failRegexp != "" {
+		var err error
+		if failRx, err = regexp.Compile(*failRegexp); err != nil {
+			log.Fatalln("Bad -fail-regexp:", err)
+		}
+	}
+
+	var ignoreRx *regexp.Regexp
+	if *ignoreRegexp != "" {
+		var err error
+		if ignoreRx, err = regexp.Compile(*ignoreRegexp); err != nil {
+			log.Fatalln("Bad -ignore-regexp:", err)
+		}
+	}
+
+	var runLogTmpl *template.Template
+	if *runLog != "" {
+		var err error
+		runLogTmpl, err = template.New("run-log").Option("missingkey=error").Parse(*runLog)
+		if err == nil {
+			err = runLogTmpl.Execute(io.Discard, runLogData{})
+		}
+		if err != nil {
+			log.Fatalln("Bad -run-log-template:", err)
+		}
+	}
+
+	// Check up front that the command can be run at all, rather than
+	// having every worker fail on its first iteration.
+	path, err := exec.LookPath(cmd.args[0])
+	if err != nil {
+		log.Fatalf("Cannot run %q: %s", cmd.args[0], err)
+	}
+
+	instrumentWrapper := strings.Fields(*instrument)
+	if len(instrumentWrapper) > 0 {
+		if _, err := exec.LookPath(instrumentWrapper[0]); err != nil {
+			log.Fatalf("Bad -instrument: cannot run %q: %s", instrumentWrapper[0], err)
+		}
+	}
+
+	if *privateTmp && *tmpdir == "" {
+		*tmpdir = os.TempDir()
+	}
+
+	code := currentGitState()
+	// Report the seed only if flake makes random choices.
+	randomized := *fixtureRandom && len(fixtures) > 0 || *chaos > 0 || proxyFaults != nil
+	for _, r := range seccompRules {
+		randomized = randomized || r.fraction < 1
+	}
+	seed := *sessionSeed
+	for seed == 0 {
+		seed = rand.Uint64()
+	}
+	fingerprint := newEnvFingerprint(path)
+
+	if *dryRun {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "Command:\t%s\n", cmd)
+		fmt.Fprintf(tw, "Executable:\t%s\n", path)
+		if code != nil {
+			fmt.Fprintf(tw, "Code:\t%s\n", code)
+		}
+		fmt.Fprintf(tw, "Environment:\t%s\n", fingerprint)
+		if goTestCmd != nil {
+			build := append([]string{goTestCmd.goTool, "test", "-c"}, goTestCmd.build...)
+			fmt.Fprintf(tw, "Compile:\t%s\n", quoteCommand(append(build, goTestCmd.pkg)))
+			fmt.Fprintf(tw, "Test flags:\t%s\n", quoteCommand(goTestCmd.testArgs))
+		}
+		if replay != nil {
+			fmt.Fprintf(tw, "Replay:\titeration %d from %s\n", replay.ID, *state)
+		} else if *state != "" {
+			fmt.Fprintf(tw, "State:\trecorded to %s\n", *state)
+		}
+		if *autoEscalate {
+			fmt.Fprintf(tw, "After failure:\tdiagnostics chosen by how the run failed\n")
+		}
+		if escalated != nil {
+			fmt.Fprintf(tw, "After failure:\t%s\n", escalated)
+		}
+		if *narrow > 0 {
+			fmt.Fprintf(tw, "Narrowing:\t%d isolated run(s) of the failing test\n", *narrow)
+		}
+		if len(instrumentWrapper) > 0 {
+			fmt.Fprintf(tw, "Instrumented:\t%s (up to %d attempts)\n", cmd.wrap(instrumentWrapper), *instrumentRuns)
+		}
+		if maxOutput > 0 {
+			fmt.Fprintf(tw, "Output kept:\tthe first and last %s of each run's output\n", maxOutput/2)
+		}
+		if *followWorker > 0 {
+			fmt.Fprintf(tw, "Follow:\tworker %d's output\n", *followWorker)
+		}
+		if *usePTY {
+			fmt.Fprintf(tw, "Terminal:\ta pseudo-terminal for each run\n")
+		}
+		if proxyFaults != nil {
+			fmt.Fprintf(tw, "Proxy faults:\t%s (delay %s), as HTTP_PROXY and HTTPS_PROXY\n", proxyFaults.spec, *proxyDelay)
+		}
+		if len(seccompRules) > 0 {
+			fmt.Fprintf(tw, "Seccomp:\t%s\n", *seccompSpec)
+		}
+		if randomized {
+			fmt.Fprintf(tw, "Session seed:\t%d\n", seed)
+		}
+		if cpuTarget > 0 {
+			fmt.Fprintf(tw, "Parallelism:\tup to %d, targeting %g%% CPU\n", *parallelism, cpuTarget*100)
+		} else {
+			fmt.Fprintf(tw, "Parallelism:\t%d\n", *parallelism)
+		}
+		if *clockSkew > 0 {
+			var offsets []string
+			for i := 1; i <= *parallelism; i++ {
+				offsets = append(offsets, workerClockOffset(i, *parallelism, *clockSkew).String())
+			}
+			fmt.Fprintf(tw, "Clock offsets:\t%s (per worker, with faketime)\n", strings.Join(offsets, ", "))
+		}
+		if len(fixtures) > 0 {
+			order := "in turn"
+			if *fixtureRandom {
+				order = "at random"
+			}
+			fmt.Fprintf(tw, "Fixtures:\t%d files from %s, %s, as FLAKE_FIXTURE\n", len(fixtures), *fixtureDir, order)
+		}
+		if *chaos > 0 {
+			fmt.Fprintf(tw, "Chaos:\tup to %s per run, as FLAKE_CHAOS\n", *chaos)
+		} else if *chaosLevel > 0 {
+			fmt.Fprintf(tw, "Chaos:\t%s for every run, as FLAKE_CHAOS\n", *chaosLevel)
+		}
+		if len(nodes) > 0 {
+			fmt.Fprintf(tw, "NUMA nodes:\t%v, assigned to workers in turn\n", nodes)
+		}
+		if *privateMounts {
+			fmt.Fprintf(tw, "Isolation:\tprivate mount namespace with tmpfs on /tmp\n")
+		}
+		if *artifacts != "" {
+			fmt.Fprintf(tw, "Artifacts:\t%s for each failing run\n", filepath.Join(*artifacts, "flake-*", "run-<run id>"))
+			if *compressArtifacts {
+				fmt.Fprintf(tw, "Artifact compression:\tgzip\n")
+			}
+			if artifactLimit > 0 {
+				fmt.Fprintf(tw, "Artifact budget:\t%s, evicting the oldest runs' artifacts\n", artifactLimit)
+			}
+		}
+		if runLogTmpl != nil {
+			fmt.Fprintf(tw, "Run logs:\t%s\n", *runLog)
+		}
+		if *cpuLimit > 0 {
+			fmt.Fprintf(tw, "CPU limit:\t%s per process\n", *cpuLimit)
+		}
+		if *timeout > 0 {
+			fmt.Fprintf(tw, "Timeout:\t%s per run\n", *timeout)
+		}
+		if *idleTimeout > 0 {
+			fmt.Fprintf(tw, "Idle timeout:\t%s\n", *idleTimeout)
+		}
+		if *grace > 0 {
+			fmt.Fprintf(tw, "Grace period:\t%s between SIGTERM and SIGKILL\n", *grace)
+		}
+		if *heartbeat > 0 {
+			fmt.Fprintf(tw, "Heartbeat:\t$FLAKE_HEARTBEAT at least every %s\n", *heartbeat)
+		}
+		if *untilSuccess {
+			fmt.Fprintf(tw, "Stop at:\tthe first run that succeeds\n")
+		}
+		if verify != nil {
+			fmt.Fprintf(tw, "Verify:\t%s (%d runs without a failure)\n", verify.spec, verify.runsNeeded())
+		}
+		if *goleak {
+			fmt.Fprintf(tw, "Fail on:\tgoroutine leak reports\n")
+		}
+		if failRx != nil {
+			fmt.Fprintf(tw, "Fail on:\toutput matching %q\n", failRx)
+		}
+		if ignoreRx != nil {
+			fmt.Fprintf(tw, "Ignore:\tfailures with output matching %q\n", ignoreRx)
+		}
+		if *maxRuns > 0 {
+			fmt.Fprintf(tw, "Stop after:\t%d iterations, passed or failed\n", *maxRuns)
+		}
+		if *maxFailures > 1 && !keepGoing {
+			fmt.Fprintf(tw, "Stop after:\t%d failures\n", *maxFailures)
+		}
+		if slo != nil {
+			fmt.Fprintf(tw, "Gate:\t%s\n", slo.spec)
+		}
+		for _, v := range variants {
+			if v.cmd != nil {
+				fmt.Fprintf(tw, "Alternate:\t%s: %s\n", v.name, v.cmd)
+			} else {
+				fmt.Fprintf(tw, "Alternate:\t%s\n", v.name)
+			}
+		}
+		if *maxTime > 0 {
+			fmt.Fprintf(tw, "Time budget:\t%s\n", *maxTime)
+		}
+		if *confirm > 0 {
+			fmt.Fprintf(tw, "Confirm:\trerun failures up to %d time(s)\n", *confirm)
+		}
+		if *sysState {
+			fmt.Fprintf(tw, "On failure:\tsave system state\n")
+		}
+		if *diagnose != "" {
+			fmt.Fprintf(tw, "On failure:\t%s\n", *diagnose)
+		}
+		if *onlyWhenIdle {
+			idle := fmt.Sprintf("no terminal input for %s", *idleAfter)
+			if *idleLoad > 0 {
+				idle += fmt.Sprintf(" and other load at most %g", *idleLoad)
+			}
+			fmt.Fprintf(tw, "Only when idle:\t%s\n", idle)
+		}
+		if minFreeMem > 0 {
+			fmt.Fprintf(tw, "Min free memory:\t%s\n", minFreeMem)
+		}
+		if !deadline.IsZero() {
+			fmt.Fprintf(tw, "Stop at:\t%s\n", deadline.Format(time.RFC3339))
+		}
+		if *tmpdir != "" {
+			fmt.Fprintf(tw, "Run tmpdir:\t%s\n", filepath.Join(*tmpdir, "flake-*", "<run id>"))
+			fmt.Fprintf(tw, "Worker tmpdir:\t%s\n", filepath.Join(*tmpdir, "flake-*", "worker-<n>"))
+			env := "FLAKEDIR"
+			if *privateTmp {
+				env += ", TMPDIR, TMP, TEMP"
+			}
+			fmt.Fprintf(tw, "Environment:\t%s set to the run tmpdir\n", env)
+			fmt.Fprintf(tw, "\tFLAKE_WORKER_DIR set to the worker tmpdir\n")
+		}
+		tw.Flush()
+		return
+	}
+	if *privateMounts && *tmpdir != "" {
+		if abs, err := filepath.Abs(*tmpdir); err == nil && (abs == "/tmp" || strings.HasPrefix(abs, "/tmp/")) {
+			log.Fatalln("-private-mounts hides /tmp from runs; use a -tmpdir outside of /tmp")
+		}
+	}
+	var keepTmpdir bool
+	if *tmpdir != "" {
+		*tmpdir, err = os.MkdirTemp(*tmpdir, "flake-")
+		if err != nil {
+			log.Fatalln("Cannot create tmpdir:", err)
+		}
+		defer func() {
+			if !keepTmpdir {
+				os.RemoveAll(*tmpdir)
+			}
+		}()
+	}
+
+	if goTestCmd != nil {
+		// The -state file records the path of the test binary, so keep
+		// it next to the state file for -replay-iteration.
+		parent, prefix := "", "flake-test-"
+		if *state != "" {
+			if parent, err = filepath.Abs(filepath.Dir(*state)); err != nil {
+				log.Fatalln("Cannot compile test:", err)
+			}
+			prefix = filepath.Base(*state) + ".test-"
+		}
+		dir, err := os.MkdirTemp(parent, prefix)
+		if err != nil {
+			log.Fatalln("Cannot compile test:", err)
+		}
+		if *state == "" {
+			defer os.RemoveAll(dir)
+		}
+		start := time.Now()
+		if cmd, err = goTestCmd.compile(dir); err != nil {
+			os.RemoveAll(dir)
+			log.Fatalln("Cannot compile test:", err)
+		}
+		if *state != "" {
+			log.Printf("Keeping the test binary in %s for -replay-iteration", dir)
+		}
+		if *gotest {
+			cmd = goTestCmd.test2json(cmd)
+		}
+		log.Printf("Compiled %s in %s; running %s", goTestCmd.pkg, time.Since(start).Round(time.Millisecond), cmd)
+	}
+
+	var (
+		store  *artifactStore
+		budget *artifactBudget
+	)
+	if *artifacts != "" {
+		if err := os.MkdirAll(*artifacts, 0o755); err != nil {
+			log.Fatalln("Cannot create -artifacts directory:", err)
+		}
+		if *artifacts, err = os.MkdirTemp(*artifacts, "flake-"); err != nil {
+			log.Fatalln("Cannot create -artifacts directory:", err)
+		}
+		store = newArtifactStore(*artifacts)
+		if artifactLimit > 0 {
+			budget = newArtifactBudget(int64(artifactLimit), store)
+		}
+	}
+
+	var events *eventStream
+	if *jsonOut {
+		events = newEventStream(os.Stdout)
+		if progressOut == os.Stdout {
+			progressTTY = false // stdout is only for events
+		}
+	}
+
+	var stateW *stateWriter
+	if *state != "" && replay == nil {
+		if stateW, err = createState(*state); err != nil {
+			log.Fatalln("Cannot create -state file:", err)
+		}
+		defer func() {
+			if err := stateW.close(); err != nil {
+				log.Printf("Cannot write -state file: %s", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var leaks leakAudit
+	pause := newPauseGate()
+	idle := newPauseGate() // closed while -only-when-idle finds the machine in use
+	var limit *limiter
+	if cpuTarget > 0 {
+		// Start at half of the maximum and let autoscale adjust from there.
+		limit = newLimiter(max(1, *parallelism/2))
+		go autoscale(ctx, limit, cpuTarget, *parallelism)
+	}
+	var mem *memAdmission
+	if minFreeMem > 0 {
+		mem = &memAdmission{minFree: int64(minFreeMem)}
+	}
+	var curCmd atomic.Pointer[command]
+	curCmd.Store(cmd)
+	var (
+		autoEscalated bool // with -auto-escalate, escalated is set after the first failure
+		quitHangs     atomic.Bool
+	)
+	// The runner only starts runs; the hooks below make and judge them.
+	runner := &flakerun.Runner{
+		Parallelism: *parallelism,
+		MaxTime:     *maxTime,
+		MaxFailures: -1, // OnResult decides when to stop
+	}
+	nextID := runner.NextID
+	var follow *follower
+	if *followWorker > 0 {
+		follow = &follower{clear: progressVT && progressOut == os.Stdout}
+	}
+	var numWorkers int
+	newWorker := func() *worker {
+		numWorkers++
+		var workerDir string
+		if *tmpdir != "" {
+			workerDir = filepath.Join(*tmpdir, fmt.Sprintf("worker-%d", numWorkers))
+			if err := os.Mkdir(workerDir, 0o755); err != nil {
+				log.Fatalln("Cannot create worker tmpdir:", err)
+			}
+		}
+		var fw *follower
+		if numWorkers == *followWorker {
+			fw = follow
+		}
+		numaNode := -1
+		if len(nodes) > 0 {
+			numaNode = nodes[(numWorkers-1)%len(nodes)]
+		}
+		return &worker{
+			num:           numWorkers,
+			numaNode:      numaNode,
+			clockOffset:   workerClockOffset(numWorkers, *parallelism, *clockSkew),
+			outBuf:        outputBuffer{limit: int64(maxOutput)},
+			follow:        fw,
+			quitHangs:     &quitHangs,
+			workerDir:     workerDir,
+			tmpdir:        *tmpdir,
+			privateTmp:    *privateTmp,
+			privateMounts: *privateMounts,
+			runLog:        runLogTmpl,
+			cpuLimit:      *cpuLimit,
+			timeout:       *timeout,
+			grace:         *grace,
+			idle:          *idleTimeout,
+			heartbeat:     *heartbeat,
+			goleak:        *goleak,
+			untilSuccess:  *untilSuccess,
+			failRx:        failRx,
+			sysState:      *sysState,
+			diagnose:      *diagnose,
+			artifacts:     *artifacts,
+			fixtures:      fixtures,
+			fixtureRandom: *fixtureRandom,
+			chaos:         *chaos,
+			chaosLevel:    *chaosLevel,
+			seccomp:       seccompRules,
+			proxy:         proxyFaults,
+			proxyDelay:    *proxyDelay,
+			pty:           *usePTY,
+			timestamps:    *timestamps,
+			seed:          seed,
+			variants:      variants,
+			gotest:        *gotest,
+			leaks:         &leaks,
+			mem:           mem,
+			state:         stateW,
+		}
+	}
+	failedDesc := "Command failed"
+	if *untilSuccess {
+		failedDesc = "Command succeeded"
+	}
+	reportFailureDetails := func(err error) {
+		if re, ok := err.(*runError); ok {
+			if len(re.tests) > 0 {
+				log.Printf("%s: %s:\n%s", failedDesc, re, formatTestFailures(re.tests))
+			} else if re.stamped != nil {
+				log.Printf("%s: %s:\n%s", failedDesc, re, re.stamped)
+			} else {
+				log.Printf("%s: %s:\n%s", failedDesc, re, re.output)
+			}
+			if re.result != nil {
+				log.Printf("Reported by the run: %s", re.result)
+			} else if re.resultErr != nil {
+				log.Printf("Cannot read result file: %s", re.resultErr)
+			}
+			if re.confirmedBy != 0 {
+				log.Printf("Confirmed by run %d, which also failed", re.confirmedBy)
+			}
+			if re.fixture != "" {
+				log.Printf("Fixture: %s", re.fixture)
+			}
+			if re.variant != "" {
+				log.Printf("Variant: %s", re.variant)
+			}
+			if re.chaos != "" {
+				log.Printf("Chaos level: %s (replay with -chaos-level %[1]s)", re.chaos)
+			}
+			if re.seccomp != "" {
+				log.Printf("Seccomp: %s (replay with -seccomp %[1]s)", re.seccomp)
+			}
+			if re.proxyFaults != "" {
+				log.Printf("Proxy faults: %s", re.proxyFaults)
+			}
+			if re.numaNode >= 0 {
+				log.Printf("NUMA node: %d", re.numaNode)
+			}
+			if re.clockOffset != 0 {
+				log.Printf("Clock offset: %s (with faketime)", re.clockOffset)
+			}
+			if re.logFile != "" {
+				log.Printf("Output log: %s", re.logFile)
+			}
+			if re.tmpdir != "" {
+				keepTmpdir = true
+				log.Printf("Kept tmpdir of failed run: %s", re.tmpdir)
+			}
+			if re.diagnosis != nil {
+				log.Printf("Output of -diagnose:\n%s", re.diagnosis)
+			}
+			if re.core != "" {
+				log.Printf("Core dump: %s", re.core)
+			}
+			if re.backtrace != nil {
+				log.Printf("Backtrace of the core dump (gdb):\n%s", re.backtrace)
+			}
+			if re.openFiles != nil && re.artifacts == "" {
+				log.Printf("Open files of the hung run:\n%s", re.openFiles)
+			}
+			if re.artifacts != "" && budget != nil && budget.isEvicted(re.artifacts) {
+				log.Printf("Artifacts: %s (evicted by -artifact-budget)", re.artifacts)
+			} else if re.artifacts != "" {
+				log.Printf("Artifacts: %s", re.artifacts)
+			} else if re.sysState != nil {
+				if name, err := saveSysState(re); err != nil {
+					log.Printf("Cannot save system state: %s", err)
+				} else {
+					log.Printf("Saved system state at failure to %s", name)
+				}
+			}
+		} else {
+			log.Printf("Error running %s: %s", cmd, err)
+		}
+	}
+	reportFailure := func(err error, n int64) {
+		if *untilSuccess {
+			log.Printf("Succeeded after %d failed iteration(s):", n)
+		} else {
+			log.Printf("Failed after %d successful iteration(s):", n)
+		}
+		reportFailureDetails(err)
+	}
+	if replay != nil {
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			<-sigs
+			cancel()
+		}()
+		log.Printf("Replaying iteration %d: %s", replay.ID, cmd)
+		err := newWorker().run(ctx, replay.ID, replayConfig)
+		switch {
+		case ctx.Err() != nil:
+			log.Printf("Interrupted")
+		case err == nil:
+			log.Printf("Iteration %d passed", replay.ID)
+		default:
+			log.Printf("Iteration %d failed again:", replay.ID)
+			reportFailureDetails(err)
+			exitStatus = exitFailed
+			if _, ok := err.(*runError); !ok {
+				exitStatus = 1
+			}
+		}
+		return
+	}
+	var trace *traceRecorder
+	if *traceFile != "" {
+		trace = newTraceRecorder(time.Now())
+	}
+	crash := newCrashRecorder()
+	go crash.sampleResources(ctx)
+	var workers []*worker
+	var activity *activityWatch
+	if *onlyWhenIdle {
+		activity = &activityWatch{
+			idleAfter: *idleAfter,
+			maxLoad:   *idleLoad,
+			running: func() int {
+				var n int
+				for _, w := range workers {
+					if w.runStart.Load() != 0 {
+						n++
+					}
+				}
+				return n
+			},
+		}
+		if reason := activity.check(); reason != "" {
+			idle.setClosed(true)
+			log.Printf("Waiting for the machine to be idle (%s)", reason)
+		}
+	}
+	for i := 0; i < *parallelism; i++ {
+		w := newWorker()
+		workers = append(workers, w)
+		crash.addWorker(w)
+		if trace != nil {
+			trace.addWorker(w.num)
+		}
+	}
+	runner.Wait = func(ctx context.Context, _ int) error {
+		if err := pause.wait(ctx); err != nil {
+			return err
+		}
+		if err := idle.wait(ctx); err != nil {
+			return err
+		}
+		if mem != nil {
+			if err := mem.wait(ctx); err != nil {
+				return err
+			}
+		}
+		if limit != nil {
+			if err := limit.acquire(ctx); err != nil {
+				if mem != nil {
+					mem.release()
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	runner.Exec = func(ctx context.Context, num int, id int64) flakerun.Result {
+		defer crash.catch(cancel)
+		w := workers[num-1]
+		rc := w.configure(id, curCmd.Load())
+		start := time.Now()
+		w.setRunning(id, start)
+		if events != nil {
+			events.start(id, w.num)
+		}
+		crash.event("worker %d: started run %d", w.num, id)
+		err := w.run(ctx, id, rc)
+		if mem != nil {
+			mem.release()
+		}
+		w.setRunning(0, time.Time{})
+		crash.event("worker %d: finished run %d: %v", w.num, id, err)
+		end := time.Now()
+		r := runResult{id: id, worker: w.num, config: rc, start: start, elapsed: end.Sub(start), clockJump: clockJump(start, end), err: err}
+		if re, ok := err.(*runError); ok {
+			re.clockJump = r.clockJump
+		}
+		if re, ok := err.(*runError); ok && ignoreRx != nil && ignoreRx.Match(re.output) {
+			r.err, r.ignored = nil, err
+		} else if ok && *confirm > 0 {
+			crash.event("worker %d: confirming failure of run %d", w.num, id)
+			re.confirmedBy = w.confirm(ctx, rc, *confirm, nextID)
+			if re.confirmedBy == 0 {
+				r.err, r.unconfirmed = nil, err
+			}
+		}
+		failure := r.err
+		if failure == nil {
+			failure = r.unconfirmed
+		}
+		if re, ok := failure.(*runError); ok && *artifacts != "" {
+			var err error
+			if re.artifacts, err = saveArtifacts(*artifacts, r, re, code, crash.recent(), *compressArtifacts); err != nil {
+				log.Printf("Cannot save artifacts of run %d: %s", id, err)
+			} else if re.tmpdir != "" {
+				// The artifacts have a copy of the tmpdir, which
+				// -artifact-budget accounts for; don't keep it twice.
+				os.RemoveAll(re.tmpdir)
+				re.tmpdir = ""
+			}
+			if re.artifacts != "" {
+				size, err := store.add(re.artifacts)
+				if err != nil {
+					log.Printf("Cannot deduplicate artifacts of run %d: %s", id, err)
+				}
+				if budget != nil {
+					budget.add(re.artifacts, size)
+				}
+			}
+		}
+		if limit != nil {
+			limit.release()
+		}
+		return flakerun.Result{ID: id, Worker: w.num, Start: start, Elapsed: r.elapsed, Err: r.err, Value: r}
+	}
+	if activity != nil {
+		go activity.watch(ctx, idle, func(reason string) {
+			if reason == "" {
+				crash.event("machine idle")
+			} else {
+				crash.event("machine in use: %s", reason)
+			}
+		})
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	var untilC <-chan time.Time
+	if !deadline.IsZero() {
+		untilC = time.After(time.Until(deadline))
+	}
+	go func(done <-chan struct{}, stop func()) {
+		select {
+		case <-sigs:
+		case <-untilC:
+		case <-done:
+			return
+		}
+		stop()
+	}(ctx.Done(), cancel)
+	if pauseSignal != nil {
+		pauseSigs := make(chan os.Signal, 1)
+		signal.Notify(pauseSigs, pauseSignal, resumeSignal)
+		go func() {
+			for sig := range pauseSigs {
+				pause.setClosed(sig == pauseSignal && !pause.isClosed())
+				crash.event("paused: %t", pause.isClosed())
+			}
+		}()
+	}
+	sessionStart := time.Now()
+	var verified bool // -verify succeeded
+	var n int64
+	var total time.Duration // of successful runs
+	var timed int64         // successful runs counted in total
+	var fastest, slowest time.Duration
+	var passing durationSample
+	var firstErr error         // the first failure
+	var failedConfig runConfig // of the first failure
+	var failures []runResult   // up to -failures of them
+	var failCount int64
+	signatures := failureSignatures{similarity: *similarity}
+	var statuses exitStatuses
+	var failing []time.Duration // of all failures, for analyzeDurations
+	var vstats []*variantStats
+	for _, v := range variants {
+		vstats = append(vstats, &variantStats{v: v})
+	}
+	var unconfirmed int // failures that were not confirmed by -confirm
+	var ignored int     // failures that matched -ignore-regexp
+	var drift []string  // changes to the fingerprint
+	lastFingerprint := time.Now()
+	avg := func() string {
+		if timed == 0 {
+			return ""
+		}
+		return fmt.Sprintf(" (avg = %s)", total/time.Duration(timed))
+	}
+	inFlight := func() string {
+		var running int
+		var oldest int64
+		for _, w := range workers {
+			if start := w.runStart.Load(); start != 0 {
+				running++
+				if oldest == 0 || start < oldest {
+					oldest = start
+				}
+			}
+		}
+		if running == 0 {
+			return ""
+		}
+		age := time.Since(time.Unix(0, oldest)).Truncate(time.Second)
+		return fmt.Sprintf(", %d running, oldest %s", running, age)
+	}
+	var (
+		recent      recentDurations
+		lastLen     int  // of the progress line, on a TTY
+		lastHistLen int  // of the histogram line under it
+		histShown   bool // and the cursor is on the histogram line
+	)
+	// clearProgress moves the cursor to the start of the progress line so
+	// that a message can replace it.
+	clearProgress := func() {
+		if !progressTTY {
+			return
+		}
+		if histShown {
+			fmt.Fprint(progressOut, "\r\x1b[K\x1b[1A")
+			histShown = false
+		}
+		fmt.Fprint(progressOut, "\r")
+	}
+	progress := func() {
+		if *quiet || events != nil && progressOut == os.Stdout {
+			return
+		}
+		status := "..."
+		if pause.isClosed() {
+			status = " (paused)"
+		} else if activity != nil && idle.isClosed() {
+			status = fmt.Sprintf(" (waiting for idle: %s)", activity.busyReason())
+		} else if mem != nil && mem.isLow() {
+			status = " (low memory)"
+		} else if limit != nil {
+			status = fmt.Sprintf(", %d parallel...", limit.getLimit())
+		}
+		var uncounted string
+		if unconfirmed > 0 {
+			uncounted += fmt.Sprintf(", %d unconfirmed failure(s)", unconfirmed)
+		}
+		if ignored > 0 {
+			uncounted += fmt.Sprintf(", %d ignored failure(s)", ignored)
+		}
+		var experiment string
+		for _, s := range vstats {
+			experiment += fmt.Sprintf(", %s", s)
+		}
+		if verify != nil {
+			experiment += fmt.Sprintf(", %d more to verify", max(0, verify.runsNeeded()-n))
+		}
+		line := fmt.Sprintf("%d iterations%s%s%s%s%s", n, avg(), uncounted, experiment, inFlight(), status)
+		if progressTTY {
+			if histShown {
+				fmt.Fprint(progressOut, "\x1b[1A")
+			}
+			// Pad to overwrite any longer previous line.
+			fmt.Fprintf(progressOut, "\r%-*s", lastLen, line)
+			lastLen = len(line)
+			// A shift in the distribution of durations can be an early
+			// sign of the conditions for a flake.
+			if hist := recent.histogram(); hist != "" && progressVT && follow == nil {
+				fmt.Fprintf(progressOut, "\n\r%-*s", lastHistLen, hist)
+				lastHistLen = utf8.RuneCountInString(hist)
+				histShown = true
+			}
+		} else {
+			fmt.Fprintln(progressOut, line)
+		}
+	}
+	var loops crashLoopDetector
+	// OnResult stops the session by cancelling ctx.
+	runner.OnResult = func(res flakerun.Result) {
+		r := res.Value.(runResult)
+		if trace != nil {
+			trace.addRun(r)
+		}
+		if events != nil {
+			events.finish(r)
+		}
+		if *verbose {
+			clearProgress()
+			line := r.String()
+			if progressTTY {
+				// Overwrite the progress line.
+				line = fmt.Sprintf("%-*s", lastLen, line)
+				lastLen = 0
+			}
+			fmt.Fprintln(progressOut, line)
+		}
+		// Durations that include a suspend or a clock change are
+		// meaningless.
+		isTimed := r.clockJump == 0 || !*excludeJumps
+		if r.clockJump != 0 {
+			clearProgress()
+			log.Printf("Warning: the wall clock jumped %s during run %d (suspend and resume, or a clock change)", r.clockJump, r.id)
+		}
+		if isTimed {
+			recent.add(r.elapsed)
+		}
+		for _, s := range vstats {
+			if s.v == r.config.variant {
+				s.runs++
+				if r.err != nil {
+					s.failures++
+				}
+			}
+		}
+		if r.unconfirmed != nil {
+			unconfirmed++
+			return
+		}
+		if r.ignored != nil {
+			ignored++
+			return
+		}
+		if r.err != nil && *autoEscalate && !autoEscalated {
+			autoEscalated = true
+			class := classifyFailure(r.err)
+			if d := chooseDiagnostics(curCmd.Load(), class); d != nil {
+				escalated = d.cmd
+				quitHangs.Store(d.quitHangs)
+				clearProgress()
+				log.Printf("The failure looks like a %s; gathering more evidence with %s", class, d.desc)
+			}
+		}
+		if r.err != nil && escalated != nil {
+			if curCmd.Load() != escalated {
+				clearProgress()
+				reportFailure(r.err, n)
+				log.Printf("Continuing with: %s", escalated)
+				curCmd.Store(escalated)
+				crash.event("escalated after failure of run %d", r.id)
+				return
+			}
+			if r.config.cmd != escalated {
+				// A run that started before escalating; ignore it
+				// and wait for a more informative failure.
+				return
+			}
+		}
+		// Without a signal to resume, stop at a crash loop
+		// (after recording this failure) rather than pausing.
+		var crashLoop bool
+		if loops.observe(r) {
+			clearProgress()
+			log.Printf("Warning: the last %d runs failed within %s each, although earlier runs passed; the command may be broken (was it deleted or rebuilt?)", crashLoopRuns, crashLoopFast)
+			crash.event("crash loop after run %d", r.id)
+			if pauseSignal == nil {
+				crashLoop = true
+			} else {
+				pause.setClosed(true)
+				log.Printf("Paused; fix the command and resume with SIGCONT (kill -CONT %d), or interrupt flake to stop", os.Getpid())
+			}
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+				failedConfig = r.config
+			}
+			failCount++
+			signatures.add(failureSignature(r.err), strconv.FormatInt(r.id, 10))
+			statuses.add(r.err)
+			if _, ok := r.err.(*runError); ok && (r.clockJump == 0 || !*excludeJumps) {
+				failing = append(failing, r.elapsed)
+			}
+			if len(failures) < *maxFailures {
+				failures = append(failures, r)
+			}
+			_, ok := r.err.(*runError)
+			if !ok || crashLoop || !keepGoing && len(failures) >= *maxFailures || *maxRuns > 0 && n+failCount >= *maxRuns {
+				cancel()
+				return
+			}
+			clearProgress()
+			if keepGoing {
+				log.Printf("Run %d failed: %s (failure %d)", r.id, r.err, failCount)
+			} else {
+				log.Printf("Run %d failed: %s (failure %d of %d)", r.id, r.err, len(failures), *maxFailures)
+			}
+			return
+		}
+		n++
+		if isTimed {
+			timed++
+			total += r.elapsed
+			passing.add(r.elapsed)
+			if timed == 1 || r.elapsed < fastest {
+				fastest = r.elapsed
+			}
+			slowest = max(slowest, r.elapsed)
+		}
+		if *maxRuns > 0 && n+failCount >= *maxRuns {
+			cancel()
+			return
+		}
+		if verify != nil {
+			if ok, _ := verify.evaluate(0, n); ok {
+				verified = true
+				cancel()
+			}
+		}
+	}
+	runner.Progress = func(flakerun.Summary) {
+		if time.Since(lastFingerprint) >= fingerprintInterval {
+			lastFingerprint = time.Now()
+			for _, change := range fingerprint.changes() {
+				drift = append(drift, fmt.Sprintf("%s after %d run(s)", change, n+failCount))
+				crash.event("%s", change)
+				clearProgress()
+				log.Printf("Warning: %s; later runs may not be comparable with earlier ones", change)
+			}
+		}
+		progress()
 	}
-
-	if *tmpdir != "" {
-		var err error
-		*tmpdir, err = os.MkdirTemp(*tmpdir, "flake-")
-		if err != nil {
-			log.Fatalln("Cannot create tmpdir:", err)
+	// Run only fails to start a Command, and flake uses Exec instead.
+	sum, _ := runner.Run(ctx)
+	outOfTime := sum.OutOfTime
+	cancel()
+	clearProgress()
+	if events != nil {
+		var s uint64
+		if randomized {
+			s = seed
 		}
-		defer os.RemoveAll(*tmpdir)
+		events.end(n, len(failures), code, s)
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	var id int64
-	results := make(chan error)
-	var wg sync.WaitGroup
-	for i := 0; i < *parallelism; i++ {
-		w := &worker{
-			cmd:    flag.Args(),
-			tmpdir: *tmpdir,
+	if budget != nil {
+		budget.report()
+	}
+	if *junit != "" {
+		if err := writeJUnit(*junit, cmd, code, sessionStart, n, total, failures, failCount); err != nil {
+			log.Printf("Cannot write JUnit report: %s", err)
 		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-				}
-				id := atomic.AddInt64(&id, 1)
-				err := w.run(ctx, id)
-				select {
-				case results <- err:
-				case <-ctx.Done():
-					return
-				}
-				if err != nil {
-					return
+	}
+	if trace != nil {
+		if err := trace.writeFile(*traceFile); err != nil {
+			log.Printf("Cannot write trace: %s", err)
+		}
+	}
+	select {
+	case <-crash.crashed:
+		if crash.file == "" {
+			log.Printf("Internal error after %d iteration(s): %s", n, crash.err)
+		} else {
+			log.Printf("Internal error after %d iteration(s): %s; saved crash details to %s", n, crash.err, crash.file)
+		}
+		exitStatus = 1
+		return
+	default:
+	}
+	if unconfirmed > 0 {
+		log.Printf("Ignored %d failure(s) that did not reproduce with -confirm", unconfirmed)
+	}
+	if ignored > 0 {
+		log.Printf("Ignored %d failure(s) matching -ignore-regexp", ignored)
+	}
+	if s := leaks.String(); s != "" {
+		log.Printf("Warning: %s", s)
+	}
+	for _, s := range drift {
+		log.Printf("Warning: %s, so the runs are not all comparable", s)
+	}
+	if code != nil {
+		log.Printf("Code: %s", code)
+	}
+	if randomized {
+		log.Printf("Session seed: %d (reproduce the session's random choices with -session-seed %[1]d)", seed)
+	}
+	if len(vstats) > 0 {
+		defer reportVariants(vstats)
+	}
+	if slo != nil {
+		defer func() {
+			ok, msg := slo.evaluate(failCount, n+failCount)
+			log.Print(msg)
+			if exitStatus != 1 {
+				exitStatus = exitFailed
+				if ok {
+					exitStatus = 0
 				}
 			}
 		}()
 	}
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
-	ticker := time.NewTicker(time.Second)
-	var n int64
-	var err error
-	start := time.Now()
-	avg := func() string {
-		if n == 0 {
-			return ""
+	if verified {
+		log.Printf("Verified: no failure in %d iteration(s), so the failure rate is below %g%% with %g%% confidence",
+			n, 100*verify.maxRate, 100*verify.confidence)
+		return
+	}
+	ranMaxRuns := *maxRuns > 0 && n+failCount >= *maxRuns
+	if firstErr == nil {
+		passed, failure := "Passed", "failure"
+		if *untilSuccess {
+			passed, failure = "Failed", "success"
+		}
+		if ranMaxRuns && timed > 0 {
+			log.Printf("%s all %d iteration(s) (avg = %s, min = %s, max = %s)", passed, n, total/time.Duration(timed), fastest, slowest)
+			return
+		}
+		if ranMaxRuns {
+			log.Printf("%s all %d iteration(s)", passed, n)
+			return
 		}
-		return fmt.Sprintf(" (avg = %s)", time.Duration(*parallelism)*time.Since(start)/time.Duration(n))
+		if outOfTime {
+			log.Printf("No %s within -max-time %s: %s %d iteration(s)%s", failure, *maxTime, strings.ToLower(passed), n, avg())
+			return
+		}
+		log.Printf("Quit after %d iteration(s)%s", n, avg())
+		return
+	}
+	exitStatus = exitFailed
+	if _, ok := firstErr.(*runError); !ok {
+		exitStatus = 1
 	}
-sigLoop:
-	for {
+	if ranMaxRuns {
+		log.Printf("Ran -max-runs %d iteration(s): %d passed and %d failed", *maxRuns, n, failCount)
+	}
+	if len(failures) > 1 {
+		reportFailures(failures, n, reportFailureDetails)
+	} else {
+		reportFailure(firstErr, n)
+	}
+	if failCount > 1 {
+		signatures.report()
+		statuses.report(n)
+	}
+	if s := analyzeDurations(&passing, failing); s != "" {
+		log.Print(s)
+	}
+	re, ok := firstErr.(*runError)
+	if !ok || *narrow == 0 && len(instrumentWrapper) == 0 {
+		return
+	}
+
+	// Rerun the failure below (in isolation or under instrumentation).
+	// Stop early if interrupted.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
 		select {
-		case err = <-results:
-			if err != nil {
-				break sigLoop
-			}
-			n++
-		case <-ticker.C:
-			if stdoutIsTTY {
-				fmt.Printf("\r%d iterations%s...", n, avg())
-			} else {
-				fmt.Printf("%d iterations%s...\n", n, avg())
-			}
 		case <-sigs:
-			break sigLoop
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if *narrow > 0 {
+		test := failedTest(re)
+		if test == "" {
+			log.Print("Cannot use -narrow: no failed test found in the output")
+		} else {
+			rc := failedConfig
+			rc.cmd = narrowGoTest(rc.cmd, test)
+			log.Printf("Rerunning %s in isolation %d time(s): %s", test, *narrow, rc.cmd)
+			workers := make([]*worker, min(int64(*parallelism), *narrow))
+			for i := range workers {
+				workers[i] = newWorker()
+			}
+			runs, failed := runIsolated(ctx, workers, rc, *narrow, nextID)
+			if ctx.Err() != nil {
+				log.Printf("Interrupted after %d isolated run(s)", runs)
+			}
+			log.Print(narrowReport(test, failCount, n+failCount, failed, runs))
+			if ctx.Err() != nil {
+				return
+			}
 		}
 	}
-	cancel()
-	wg.Wait()
-	if stdoutIsTTY {
-		fmt.Print("\r")
-	}
-	if err == nil {
-		log.Printf("Quit after %d iteration(s)%s", n, avg())
+	if len(instrumentWrapper) == 0 {
 		return
 	}
-	log.Printf("Failed after %d successful iteration(s):", n)
+
+	// Try to reproduce the failure under instrumentation.
+	rc := failedConfig
+	rc.cmd = rc.cmd.wrap(instrumentWrapper)
+	c := rc.cmd
+	log.Printf("Rerunning up to %d time(s) under instrumentation: %s", *instrumentRuns, c)
+	w := newWorker()
+	for i := 1; i <= *instrumentRuns; i++ {
+		err := w.run(ctx, nextID(), rc)
+		if ctx.Err() != nil {
+			log.Printf("Interrupted after %d instrumented attempt(s)", i-1)
+			return
+		}
+		if _, ok := err.(*runError); ok {
+			log.Printf("Reproduced under instrumentation on attempt %d:", i)
+			reportFailure(err, int64(i-1))
+			return
+		}
+		if err != nil {
+			log.Printf("Error running %s: %s", c, err)
+			return
+		}
+	}
+	log.Printf("Did not reproduce under instrumentation in %d attempt(s)", *instrumentRuns)
+}
+
+type worker struct {
+	num           int
+	runStart      atomic.Int64       // UnixNano of the current run's start, or 0
+	runID         atomic.Int64       // ID of the current run, or 0
+	numaNode      int                // bind runs to this node if nonnegative
+	clockOffset   time.Duration      // with -clock-skew, run under faketime if nonzero
+	quitHangs     *atomic.Bool       // send SIGQUIT to hung runs before killing them
+	workerDir     string             // persists across runs; use if nonempty
+	tmpdir        string             // use if nonempty
+	privateTmp    bool               // point TMPDIR and friends at the run's tmpdir
+	privateMounts bool               // run in a mount namespace with a private /tmp
+	runLog        *template.Template // names a file for each run's output; may be nil
+	cpuLimit      time.Duration      // use if nonzero
+	timeout       time.Duration      // use if nonzero
+	grace         time.Duration      // between SIGTERM and SIGKILL, if nonzero
+	idle          time.Duration      // use if nonzero
+	heartbeat     time.Duration      // use if nonzero
+	goleak        bool               // fail runs that report leaked goroutines
+	untilSuccess  bool               // treat successful runs as failures and vice versa
+	failRx        *regexp.Regexp     // fail runs whose output matches
+	sysState      bool               // capture system state on failure
+	diagnose      string             // shell command to run on failure, if nonempty
+	artifacts     string             // the -artifacts directory, if any
+	fixtures      []string           // assigned to runs, if any
+	fixtureRandom bool
+	variants      []*variant    // alternated between runs, if any
+	gotest        bool          // parse go test -json output
+	chaos         time.Duration // maximum random chaos level, if nonzero
+	chaosLevel    time.Duration // fixed chaos level, if nonzero
+	seccomp       []seccompRule
+	proxy         *proxyFaults // if non-nil, start a -proxy for each run
+	proxyDelay    time.Duration
+	pty           bool      // run commands in a pseudo-terminal
+	timestamps    bool      // record timestamped stdout and stderr
+	follow        *follower // print the output of runs live, if non-nil
+	seed          uint64    // the session seed
+	leaks         *leakAudit
+	mem           *memAdmission // nil unless -min-free-mem is set
+	state         *stateWriter  // nil unless -state is set
+	outBuf        outputBuffer
+}
+
+type runResult struct {
+	id      int64
+	worker  int
+	config  runConfig
+	start   time.Time
+	elapsed time.Duration
+	// clockJump is how far the wall clock jumped during the run, if at
+	// all (see clockJump).
+	clockJump time.Duration
+	err       error
+	// unconfirmed is a failure that did not reproduce with -confirm
+	// (in which case err is nil).
+	unconfirmed error
+	// ignored is a failure that matched -ignore-regexp (in which case err
+	// is nil).
+	ignored error
+}
+
+// String summarizes r in one line, for -v.
+func (r runResult) String() string {
+	result := "ok"
+	err := r.err
+	switch {
+	case r.unconfirmed != nil:
+		result, err = "unconfirmed failure", r.unconfirmed
+	case r.ignored != nil:
+		result, err = "ignored failure", r.ignored
+	case err != nil:
+		result = "FAIL"
+	}
+	status := "exit status 0"
 	if re, ok := err.(*runError); ok {
-		log.Printf("Command failed: %s:\n%s", re, re.output)
+		status = re.state.String()
+	} else if err != nil {
+		status = err.Error()
+	}
+	return fmt.Sprintf("run %d (worker %d): %s in %s, %s",
+		r.id, r.worker, result, r.elapsed.Round(time.Millisecond), status)
+}
+
+// setRunning records that run id started at start; id 0 means that the
+// worker is idle.
+func (w *worker) setRunning(id int64, start time.Time) {
+	if id == 0 {
+		w.runStart.Store(0)
 	} else {
-		log.Printf("Error running %q: %s", flag.Args(), err)
+		w.runStart.Store(start.UnixNano())
 	}
+	w.runID.Store(id)
 }
 
-type worker struct {
-	cmd    []string
-	tmpdir string // use if nonempty
-	outBuf bytes.Buffer
+// A runConfig is everything that determines a run, so that it can be
+// repeated exactly.
+type runConfig struct {
+	cmd     *command
+	fixture string // file from -fixture-dir, if any
+	chaos   string // value of FLAKE_CHAOS, if any
+	seccomp string // -seccomp rules that apply to the run, if any
+	variant *variant
+
+	proxy      *proxyFaults // -proxy faults to inject, if any
+	proxyDelay time.Duration
+	seed       uint64 // the session seed, from which the proxy's choices derive
+}
+
+// configure chooses the configuration for run id using command c.
+func (w *worker) configure(id int64, c *command) runConfig {
+	rc := runConfig{cmd: c}
+	// The choices for a run depend only on the session seed and the run's
+	// number, not on the order in which workers start runs.
+	rng := rand.New(rand.NewPCG(w.seed, uint64(id)))
+	if len(w.fixtures) > 0 {
+		if w.fixtureRandom {
+			rc.fixture = w.fixtures[rng.IntN(len(w.fixtures))]
+		} else {
+			rc.fixture = w.fixtures[(id-1)%int64(len(w.fixtures))]
+		}
+	}
+	if len(w.variants) > 0 {
+		rc.variant = w.variants[(id-1)%int64(len(w.variants))]
+		if rc.variant.cmd != nil {
+			rc.cmd = rc.variant.cmd
+		}
+	}
+	switch {
+	case w.chaos > 0:
+		level := time.Duration(rng.Int64N(int64(w.chaos) + 1))
+		rc.chaos = level.Round(time.Microsecond).String()
+	case w.chaosLevel > 0:
+		rc.chaos = w.chaosLevel.String()
+	}
+	var rules []string
+	for _, r := range w.seccomp {
+		if r.fraction >= 1 || rng.Float64() < r.fraction {
+			rules = append(rules, r.String())
+		}
+	}
+	rc.seccomp = strings.Join(rules, ",")
+	if w.proxy != nil {
+		rc.proxy, rc.proxyDelay, rc.seed = w.proxy, w.proxyDelay, w.seed
+	}
+	return rc
+}
+
+// confirm reruns rc up to n times, stopping at the first rerun that fails,
+// and returns the ID of that rerun (or 0 if none failed).
+func (w *worker) confirm(ctx context.Context, rc runConfig, n int, nextID func() int64) int64 {
+	for range n {
+		id := nextID()
+		w.setRunning(id, time.Now())
+		err := w.run(ctx, id, rc)
+		w.setRunning(0, time.Time{})
+		if ctx.Err() != nil {
+			return 0
+		}
+		if _, ok := err.(*runError); ok {
+			return id
+		}
+	}
+	return 0
 }
 
 type runError struct {
 	state  *os.ProcessState
 	output []byte
+	tmpdir string // kept for inspection if nonempty
+	reason string // why flake killed the run, if it did
+
+	goroutineLeak bool   // output contains a goroutine leak report
+	failMatched   bool   // output matched -fail-regexp
+	failMatch     string // what matched
+	clockJump     time.Duration
+
+	tests []*testFailure // from go test -json output, with -gotest
+
+	sysState    []byte // snapshot taken at failure time, if requested
+	diagnosis   []byte // output of -diagnose, if requested
+	openFiles   []byte // of a hung run before it was killed (Linux only)
+	core        string // core dump of a crash, if found
+	backtrace   []byte // of the core dump, if gdb is installed
+	fixture     string // file from -fixture-dir, if any
+	chaos       string // value of FLAKE_CHAOS, if any
+	seccomp     string // -seccomp rules that applied, if any
+	proxyFaults string // faults injected by -proxy, if used
+	stamped     []byte // with -timestamps, the timestamped output
+	stdout      []byte // and each stream separately
+	stderr      []byte
+	variant     string // name of the experiment variant, if any
+	numaNode    int    // or -1
+	clockOffset time.Duration
+	logFile     string // copy of the output, if any
+
+	env       []string     // the run's environment
+	artifacts string       // directory of saved artifacts, if any
+	result    *childResult // from $FLAKE_RESULT_FILE, if written
+	resultErr error        // from reading $FLAKE_RESULT_FILE
+
+	confirmedBy int64 // ID of the -confirm rerun that also failed
+}
+
+// exitStatus describes how the run ended, without the details of Error, to
+// group failures in the exit-status breakdown: the reason flake killed it,
+// the signal that terminated it, or its exit status.
+func (re *runError) exitStatus() string {
+	status := re.state.Sys().(syscall.WaitStatus)
+	switch {
+	case re.reason != "":
+		return re.reason
+	case status.Signaled():
+		return fmt.Sprintf("signal %q", status.Signal())
+	default:
+		return fmt.Sprintf("status %d", status.ExitStatus())
+	}
 }
 
 func (re *runError) Error() string {
+	var msg string
 	status := re.state.Sys().(syscall.WaitStatus)
-	if status.Signaled() {
-		return fmt.Sprintf("got signal %q", status.Signal())
+	switch {
+	case re.reason != "":
+		msg = re.reason
+	case status.Signaled():
+		msg = fmt.Sprintf("got signal %q", status.Signal())
+	default:
+		msg = fmt.Sprintf("status %d", status.ExitStatus())
+	}
+	if len(re.tests) > 0 {
+		var names []string
+		for _, f := range re.tests[:min(len(re.tests), 3)] {
+			names = append(names, f.name())
+		}
+		msg += " in " + strings.Join(names, ", ")
+		if len(re.tests) > 3 {
+			msg += fmt.Sprintf(" and %d more", len(re.tests)-3)
+		}
 	}
-	return fmt.Sprintf("status %d", status.ExitStatus())
+	if re.goroutineLeak {
+		msg += " (goroutine leak)"
+	}
+	if re.failMatched {
+		match := re.failMatch
+		if len(match) > 60 {
+			match = match[:60] + "..."
+		}
+		msg += fmt.Sprintf(" (output matched -fail-regexp: %q)", match)
+	}
+	if re.clockJump != 0 {
+		msg += " (clock jumped)"
+	}
+	return msg
 }
 
-func (w *worker) run(ctx context.Context, id int64) error {
-	cmd := commandContext(ctx, w.cmd[0], w.cmd[1:]...)
-	w.outBuf.Reset()
-	cmd.Stdout = &w.outBuf
-	cmd.Stderr = &w.outBuf
+func (w *worker) run(ctx context.Context, id int64, rc runConfig) error {
+	if w.state != nil {
+		w.state.record(id, w.num, rc)
+	}
+	c := rc.cmd
+	var tmpdir string
 	if w.tmpdir != "" {
-		tmpdir := filepath.Join(w.tmpdir, strconv.FormatInt(id, 10))
+		tmpdir = filepath.Join(w.tmpdir, strconv.FormatInt(id, 10))
 		if err := os.Mkdir(tmpdir, 0o755); err != nil {
 			return err
 		}
-		defer os.RemoveAll(tmpdir)
-		cmd.Env = append(cmd.Environ(), fmt.Sprintf("FLAKEDIR=%s", tmpdir))
 	}
-	err := cmd.Run()
-	if ee, ok := err.(*exec.ExitError); ok {
-		return &runError{
-			state:  ee.ProcessState,
-			output: slices.Clone(w.outBuf.Bytes()),
+	runCtx, kill := context.WithCancel(ctx)
+	defer kill()
+	if rc.seccomp != "" || w.cpuLimit > 0 {
+		// Flake installs the filter and sets the limit, so that they
+		// apply from the start, and then executes the command.
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		c = c.wrap([]string{exe})
+	}
+	if w.clockOffset != 0 {
+		c = c.wrap(faketimeWrapper(w.clockOffset))
+	}
+	if w.numaNode >= 0 {
+		node := strconv.Itoa(w.numaNode)
+		c = c.wrap([]string{"numactl", "--cpunodebind=" + node, "--membind=" + node})
+	}
+	if w.privateMounts {
+		c = c.wrap(privateMountsWrapper)
+	}
+	argv := c.argv(tmpdir)
+	cmd := flakerun.CommandContextGrace(runCtx, w.grace, argv[0], argv[1:]...)
+	if len(c.env) > 0 {
+		cmd.Env = append(cmd.Environ(), c.env...)
+	}
+	cmd.Dir = c.dir
+	w.outBuf.Reset()
+	out := &activityWriter{w: &w.outBuf}
+	var logFile string
+	if w.runLog != nil {
+		f, err := w.createRunLog(id)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		logFile = f.Name()
+		out.w = io.MultiWriter(&w.outBuf, f)
+	}
+	var followed *followRun
+	if w.follow != nil {
+		followed = w.follow.run(id)
+		out.w = io.MultiWriter(out.w, followed)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	var stdout, stderr *stampedStream
+	var stamped *stampedOutput
+	if w.timestamps {
+		stamped = newStampedOutput(time.Now(), w.outBuf.limit)
+		stdout, stderr = stamped.stream("stdout", out), stamped.stream("stderr", out)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+	}
+	var term *pty
+	if w.pty {
+		var err error
+		if term, err = openPTY(); err != nil {
+			return err
+		}
+		defer term.close()
+		term.attach(cmd)
+	}
+	if rc.fixture != "" {
+		cmd.Env = append(cmd.Environ(), "FLAKE_FIXTURE="+rc.fixture)
+	}
+	if rc.chaos != "" {
+		cmd.Env = append(cmd.Environ(), "FLAKE_CHAOS="+rc.chaos)
+	}
+	if w.timeout > 0 {
+		// Let the command time itself out first, with useful output.
+		deadline := time.Now().Add(w.timeout)
+		cmd.Env = append(cmd.Environ(),
+			"FLAKE_DEADLINE="+deadline.Format(time.RFC3339Nano),
+			"FLAKE_TIMEOUT="+w.timeout.String(),
+		)
+	}
+	if rc.seccomp != "" {
+		cmd.Env = append(cmd.Environ(), seccompEnv+"="+rc.seccomp)
+	}
+	if w.cpuLimit > 0 {
+		cmd.Env = append(cmd.Environ(), cpuLimitEnv+"="+w.cpuLimit.String())
+	}
+	var proxy *faultProxy
+	if rc.proxy != nil {
+		// Seed the proxy's choices like configure's, but from a
+		// different stream. (Which request gets which fault still
+		// depends on the order in which the requests arrive.)
+		rng := rand.New(rand.NewPCG(rc.seed, ^uint64(id)))
+		p, err := startFaultProxy(rc.proxy, rc.proxyDelay, rng)
+		if err != nil {
+			return err
+		}
+		defer p.close()
+		proxy = p
+		cmd.Env = append(cmd.Environ(), p.env()...)
+	}
+	if rc.variant != nil && rc.variant.coldCache {
+		cacheDir, err := os.MkdirTemp(tmpdir, "flake-cache-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(cacheDir)
+		cmd.Env = append(cmd.Environ(), coldCacheEnv(cacheDir)...)
+	}
+	var resultName string
+	if tmpdir != "" || !w.privateMounts {
+		resultName = resultFile(id, tmpdir)
+		cmd.Env = append(cmd.Environ(), "FLAKE_RESULT_FILE="+resultName)
+	}
+	var heartbeatName string
+	if w.heartbeat > 0 && (tmpdir != "" || !w.privateMounts) {
+		heartbeatName = heartbeatFile(id, tmpdir)
+		// The heartbeat is fresh when the run starts.
+		if err := os.WriteFile(heartbeatName, nil, 0o644); err != nil {
+			return err
+		}
+		defer os.Remove(heartbeatName)
+		cmd.Env = append(cmd.Environ(), "FLAKE_HEARTBEAT="+heartbeatName)
+	}
+	if tmpdir != "" {
+		cmd.Env = append(cmd.Environ(), "FLAKEDIR="+tmpdir, "FLAKE_WORKER_DIR="+w.workerDir)
+		if w.privateTmp {
+			cmd.Env = append(cmd.Env, "TMPDIR="+tmpdir, "TMP="+tmpdir, "TEMP="+tmpdir)
+		}
+	}
+	var reason atomic.Value // string
+	// Gather evidence about a failure once, either just before flake kills
+	// the run or right after it fails.
+	var (
+		collectOnce sync.Once
+		sysState    []byte
+		diagnosis   []byte
+		fds         []byte
+	)
+	collect := func() {
+		collectOnce.Do(func() {
+			if _, hung := reason.Load().(string); hung {
+				// What a hung run is waiting for is often in its
+				// open files and sockets.
+				fds = openFiles(cmd.Process.Pid)
+			}
+			if w.sysState {
+				sysState = captureSysState()
+			}
+			if w.diagnose != "" {
+				var artifacts string
+				if w.artifacts != "" {
+					artifacts = artifactDir(w.artifacts, id)
+				}
+				diagnosis = runDiagnose(w.diagnose, id, cmd.Process.Pid, tmpdir, artifacts)
+			}
+		})
+	}
+	// killHung kills a run that flake decided is hung, first asking it
+	// to print its goroutines if -auto-escalate chose that.
+	exited := make(chan struct{})
+	killHung := func(why string) {
+		reason.Store(why)
+		collect()
+		if w.quitHangs != nil && w.quitHangs.Load() && signalGroup(cmd.Process.Pid, quitSignal) == nil {
+			select {
+			case <-exited:
+			case <-time.After(hangQuitWait):
+			}
+		}
+		kill()
+	}
+	started := time.Now()
+	err := flakerun.Start(cmd)
+	if err == nil {
+		if term != nil {
+			term.copyOutput(out)
+		}
+		if w.mem != nil {
+			w.mem.started(cmd.Process.Pid)
+			defer w.mem.exited(cmd.Process.Pid)
+		}
+		if w.timeout > 0 {
+			t := time.AfterFunc(w.timeout, func() {
+				killHung(fmt.Sprintf("hang: exceeded -timeout %s", w.timeout))
+			})
+			defer t.Stop()
+		}
+		if heartbeatName != "" {
+			go watchHeartbeat(runCtx, heartbeatName, w.heartbeat, func() {
+				killHung(fmt.Sprintf("hang: no heartbeat for %s", w.heartbeat))
+			})
+		}
+		if w.idle > 0 {
+			go watchIdle(runCtx, cmd.Process.Pid, out, w.idle, func() {
+				killHung(fmt.Sprintf("likely deadlock: no CPU use or output for %s", w.idle))
+			})
+		}
+		err = cmd.Wait()
+		close(exited)
+	}
+	if term != nil {
+		term.close() // finish reading the output
+	}
+	if followed != nil {
+		followed.flush()
+	}
+	if cmd.ProcessState != nil {
+		if runCtx.Err() == nil {
+			// If the run was killed, so was the rest of its process group.
+			w.leaks.check(id, cmd.Process.Pid)
+		}
+		if w.mem != nil {
+			w.mem.observe(maxRSS(cmd.ProcessState))
+		}
+	}
+	var result *childResult
+	var resultErr error
+	if resultName != "" {
+		result, resultErr = readResultFile(resultName)
+	}
+	leaked := goroutineLeakRx.Match(w.outBuf.Bytes())
+	var matched bool
+	var failMatch string
+	if w.failRx != nil {
+		out := w.outBuf.Bytes()
+		if w.gotest {
+			_, out = parseTestJSON(out)
+		}
+		if loc := w.failRx.FindIndex(out); loc != nil {
+			matched, failMatch = true, string(out[loc[0]:loc[1]])
+		}
+	}
+	failed := err != nil || leaked && w.goleak || matched
+	var exitErr *exec.ExitError
+	if w.untilSuccess && (err == nil || errors.As(err, &exitErr)) {
+		failed, err = !failed, nil
+	}
+	if cmd.ProcessState != nil && ctx.Err() == nil && failed {
+		// Leave the tmpdir of a failed run in place for inspection.
+		re := &runError{
+			state:         cmd.ProcessState,
+			output:        slices.Clone(w.outBuf.Bytes()),
+			tmpdir:        tmpdir,
+			goroutineLeak: leaked,
+			failMatched:   matched,
+			failMatch:     failMatch,
+			fixture:       rc.fixture,
+			chaos:         rc.chaos,
+			seccomp:       rc.seccomp,
+			numaNode:      w.numaNode,
+			clockOffset:   w.clockOffset,
+			logFile:       logFile,
+			env:           cmd.Environ(),
+			result:        result,
+			resultErr:     resultErr,
+		}
+		if proxy != nil {
+			re.proxyFaults = proxy.String()
+		}
+		if stamped != nil {
+			re.stamped = stamped.interleaved()
+			re.stdout, re.stderr = stdout.bytes(), stderr.bytes()
+		}
+		collect()
+		re.sysState = sysState
+		re.diagnosis = diagnosis
+		re.openFiles = fds
+		if w.gotest {
+			re.tests, re.output = parseTestJSON(re.output)
 		}
+		if rc.variant != nil {
+			re.variant = rc.variant.name
+		}
+		if r, ok := reason.Load().(string); ok {
+			re.reason = r
+		} else if w.cpuLimit > 0 && exceededCPULimit(cmd.ProcessState, w.cpuLimit) {
+			re.reason = "CPU runaway: exceeded -cpu-limit"
+		}
+		if classifyFailure(re) == "crash" {
+			if re.core = findCore(c.dir, started.Truncate(time.Second)); re.core != "" {
+				var exe string
+				if status := cmd.ProcessState.Sys().(syscall.WaitStatus); status.CoreDump() {
+					// The command itself crashed, not one of
+					// its children.
+					exe = commandPath(c.args[0], c.dir)
+				}
+				re.backtrace = coreBacktrace(re.core, exe)
+			}
+		}
+		return re
+	}
+	if tmpdir != "" {
+		os.RemoveAll(tmpdir)
 	}
 	return err
 }
 
+// A command is a command line to run, along with any environment variables
+// to set in addition to flake's own environment.
+type command struct {
+	args []string
+	env  []string
+	dir  string // working directory, if not flake's
+	// wrapper is a command prefix, such as a tracer, that runs args. In
+	// its words, $FLAKEDIR expands to the run's tmpdir.
+	wrapper []string
+}
+
+var envAssignmentRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// escalate returns a copy of c with extra appended to its arguments. As in
+// a shell, any leading words of the form NAME=value are instead added to
+// the environment.
+func (c *command) escalate(extra []string) *command {
+	i := 0
+	for i < len(extra) && envAssignmentRx.MatchString(extra[i]) {
+		i++
+	}
+	return &command{
+		args:    append(slices.Clone(c.args), extra[i:]...),
+		env:     append(slices.Clone(c.env), extra[:i]...),
+		dir:     c.dir,
+		wrapper: c.wrapper,
+	}
+}
+
+// wrap returns a copy of c that runs under wrapper.
+func (c *command) wrap(wrapper []string) *command {
+	return &command{
+		args:    c.args,
+		env:     c.env,
+		dir:     c.dir,
+		wrapper: append(slices.Clone(wrapper), c.wrapper...),
+	}
+}
+
+// argv returns the full command line of c for a run using flakedir.
+func (c *command) argv(flakedir string) []string {
+	argv := make([]string, 0, len(c.wrapper)+len(c.args))
+	for _, word := range c.wrapper {
+		argv = append(argv, os.Expand(word, func(name string) string {
+			if name == "FLAKEDIR" {
+				return flakedir
+			}
+			return "$" + name
+		}))
+	}
+	return append(argv, c.args...)
+}
+
+func (c *command) String() string {
+	return quoteCommand(slices.Concat(c.env, c.wrapper, c.args))
+}
+
+// privateMountsWrapper runs a command in a new mount namespace with a
+// fresh tmpfs mounted on /tmp. Unprivileged users need a user namespace
+// (in which they are root) to create the mount namespace.
+var privateMountsWrapper = func() []string {
+	w := []string{"unshare", "--mount", "--propagation", "private"}
+	if os.Geteuid() != 0 {
+		w = append(w, "--map-root-user")
+	}
+	return append(w, "sh", "-c", `mount -t tmpfs tmpfs /tmp && exec "$@"`, "flake-private-mounts")
+}()
+
+// listFixtures returns the absolute paths of the regular files in dir.
+func listFixtures(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %s", dir)
+	}
+	return files, nil
+}
+
+// goroutineLeakRx matches the reports printed by go.uber.org/goleak.
+var goroutineLeakRx = regexp.MustCompile(`found unexpected goroutines`)
+
+type runLogData struct {
+	ID     int64
+	Worker int
+}
+
+func (w *worker) createRunLog(id int64) (*os.File, error) {
+	var buf strings.Builder
+	if err := w.runLog.Execute(&buf, runLogData{ID: id, Worker: w.num}); err != nil {
+		return nil, err
+	}
+	name := buf.String()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+// parseUntil parses the argument to -until. A time of day refers to its
+// next occurrence after now; an RFC 3339 time must be after now.
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("%s is not in the future", s)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			continue
+		}
+		y, m, d := now.Date()
+		t = time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time of day or RFC 3339 time", s)
+}
+
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%"
+
+// quoteCommand formats args as a shell command line, quoting arguments
+// as needed.
+func quoteCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, shellSafeChars) == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
 func usage() {
 	fmt.Fprint(os.Stderr, `usage:
 
   flake [flags...] <command> [args...]
+  flake triage -budget <duration> [flags...] <file>
+  flake order [flags...] go test [flags...] [package]
+  flake bisect -good <commit> [flags...] <command> [args...]
+  flake report [flags...] <file>
+  flake bundle [flags...] <run dir>
+  flake diff <run dir> <run dir>
+  flake merge-report <file>...
+  flake history diff <before> <after>
 
 where the flags are:
 
 `)
-	flag.PrintDefaults()
+	printDefaults()
 	fmt.Fprint(os.Stderr, `
 Flake runs the provided command until it fails by exiting with a nonzero status.
 It only prints the output of the failed run.
+
+Flake exits with status 3 if a run failed and 0 if it stopped without a
+failure (because of -max-runs, -max-time, -until, or ^C); other errors exit
+with status 1 or 2.
+
+Flake triage splits a time budget between many suspect commands, listed in a
+file, and ranks them by how often they fail; see flake triage -h. With
+-stdin-commands, flake does the same for commands read from stdin.
+
+Flake order looks for tests of a package that fail only when they run after
+certain other tests, using go test -shuffle; see flake order -h.
+
+Flake bisect runs git bisect to find the commit that made a command flaky,
+running the command enough times at each commit; see flake bisect -h.
+
+Flake report writes a text, Markdown, or HTML report of a session recorded
+with -json; see flake report -h.
+
+Flake bundle packs the artifacts of a failing run saved with -artifacts, and a
+script to rerun it, into a single file; see flake bundle -h.
+
+Flake diff compares the artifacts of two failing runs saved with -artifacts;
+see flake diff -h.
+
+Flake merge-report combines the -json output of several sessions into one
+report; see flake merge-report -h.
+
+Flake history diff compares the failure rates of two sessions recorded with
+-json; see flake history -h.
+
+On Unix systems, ^Z (SIGTSTP) pauses the starting of new runs while letting
+in-flight runs finish; press ^Z again or send SIGCONT to resume.
 `)
 }
+
+// printDefaults is like flag.PrintDefaults but omits hidden flags.
+func printDefaults() {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fs.PrintDefaults()
+}
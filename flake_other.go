@@ -4,9 +4,28 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
 	"os/exec"
+	"time"
 )
 
-func commandContext(ctx context.Context, command string, args ...string) *exec.Cmd {
-	return exec.CommandContext(ctx, command, args...)
+// shellCommand returns a command that runs s using the shell.
+func shellCommand(ctx context.Context, s string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", s)
 }
+
+// maxRSS is not implemented on this platform.
+func maxRSS(state *os.ProcessState) int64 { return 0 }
+
+func exceededCPULimit(state *os.ProcessState, limit time.Duration) bool { return false }
+
+// There is no signal to ask a program for its goroutines on this platform.
+var quitSignal os.Signal
+
+func signalGroup(pgid int, sig os.Signal) error {
+	return errors.New("signals are not supported on this platform")
+}
+
+// Pausing with signals is not supported on this platform.
+var pauseSignal, resumeSignal os.Signal
@@ -4,16 +4,60 @@ package main
 
 import (
 	"context"
+	"os"
 	"os/exec"
+	"runtime"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func commandContext(ctx context.Context, command string, args ...string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
-	cmd.Cancel = func() error {
-		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+// shellCommand returns a command that runs s using the shell.
+func shellCommand(ctx context.Context, s string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", s)
+}
+
+// maxRSS returns the peak resident set size of a finished process in bytes.
+func maxRSS(state *os.ProcessState) int64 {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) << 10
+}
+
+// exceededCPULimit reports whether a process was killed for using more
+// than limit CPU time.
+func exceededCPULimit(state *os.ProcessState, limit time.Duration) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
 	}
-	return cmd
+	switch status.Signal() {
+	case unix.SIGXCPU:
+		return true
+	case unix.SIGKILL:
+		// Killed at the hard limit after ignoring SIGXCPU.
+		return state.UserTime()+state.SystemTime() >= limit
+	}
+	return false
+}
+
+// quitSignal asks a Go program to print its goroutines and exit.
+var quitSignal os.Signal = unix.SIGQUIT
+
+// signalGroup sends sig to the process group pgid.
+func signalGroup(pgid int, sig os.Signal) error {
+	return unix.Kill(-pgid, sig.(unix.Signal))
 }
+
+// pauseSignal toggles whether new runs are started (the terminal sends it
+// for ^Z); resumeSignal always resumes.
+var (
+	pauseSignal  os.Signal = unix.SIGTSTP
+	resumeSignal os.Signal = unix.SIGCONT
+)
@@ -0,0 +1,31 @@
+//go:build !unix && !windows
+
+package flakerun
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// ProcessGroups reports whether CommandContext starts each command in its
+// own process group (whose ID is the command's PID). There are no process
+// groups on this platform.
+const ProcessGroups = false
+
+// CommandContext is exec.CommandContext; process groups are not supported on
+// this platform.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// CommandContextGrace is CommandContext: there is no signal to ask processes
+// to exit on this platform, so they are killed at once.
+func CommandContextGrace(ctx context.Context, grace time.Duration, name string, args ...string) *exec.Cmd {
+	return CommandContext(ctx, name, args...)
+}
+
+// Start is cmd.Start.
+func Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
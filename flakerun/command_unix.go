@@ -0,0 +1,49 @@
+//go:build unix
+
+package flakerun
+
+import (
+	"context"
+	"os/exec"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProcessGroups reports whether CommandContext starts each command in its
+// own process group (whose ID is the command's PID).
+const ProcessGroups = true
+
+// CommandContext is like exec.CommandContext, but the command is started in
+// its own process group and, when ctx is done, the whole group is killed.
+// This stops any processes that the command left running.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	}
+	return cmd
+}
+
+// CommandContextGrace is like CommandContext, but when ctx is done, the
+// process group is sent SIGTERM, giving its processes a chance to clean up,
+// and only killed with SIGKILL after grace. A zero grace kills it at once.
+func CommandContextGrace(ctx context.Context, grace time.Duration, name string, args ...string) *exec.Cmd {
+	cmd := CommandContext(ctx, name, args...)
+	if grace > 0 {
+		cmd.Cancel = func() error {
+			pgid := -cmd.Process.Pid
+			time.AfterFunc(grace, func() { unix.Kill(pgid, unix.SIGKILL) })
+			return unix.Kill(pgid, unix.SIGTERM)
+		}
+	}
+	return cmd
+}
+
+// Start starts a command made by CommandContext or CommandContextGrace. It
+// is cmd.Start; on Windows, it also puts the process in a job object, so
+// callers should use it rather than cmd.Start.
+func Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
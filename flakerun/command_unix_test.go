@@ -0,0 +1,74 @@
+//go:build unix
+
+package flakerun
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// startShell starts a shell script with CommandContextGrace and returns the
+// first line that it prints.
+func startShell(t *testing.T, ctx context.Context, grace time.Duration, script string) (wait func() (string, error), first string) {
+	t.Helper()
+	cmd := CommandContextGrace(ctx, grace, "sh", "-c", script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(stdout)
+	first, err = r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait = func() (string, error) {
+		var rest strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			rest.WriteString(line)
+			if err != nil {
+				break
+			}
+		}
+		return rest.String(), cmd.Wait()
+	}
+	return wait, strings.TrimSpace(first)
+}
+
+func TestCancelKillsGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// The background sleep is left running, but it is in the group.
+	wait, first := startShell(t, ctx, 0, "sleep 60 & echo $!; wait")
+	pid, err := strconv.Atoi(first)
+	if err != nil {
+		t.Fatalf("bad PID %q", first)
+	}
+	cancel()
+	wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for unix.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("background process %d is still running after cancelling", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wait, _ := startShell(t, ctx, 10*time.Second, `trap 'echo terminated; exit 0' TERM; echo ready; sleep 60 & wait`)
+	cancel()
+	out, _ := wait()
+	if !strings.Contains(out, "terminated") {
+		t.Fatalf("the command did not get SIGTERM; output: %q", out)
+	}
+}
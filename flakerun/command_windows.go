@@ -0,0 +1,114 @@
+//go:build windows
+
+package flakerun
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// ProcessGroups reports whether CommandContext starts each command in its
+// own process group (whose ID is the command's PID). On Windows, commands
+// run in job objects instead.
+const ProcessGroups = false
+
+// CommandContext is like exec.CommandContext, but Start puts the command in
+// its own job object and, when ctx is done, the whole job is terminated.
+// This stops any processes that the command left running, as process groups
+// do on Unix.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// CommandContextGrace is CommandContext: there is no signal to ask processes
+// to exit on Windows, so they are killed at once.
+func CommandContextGrace(ctx context.Context, grace time.Duration, name string, args ...string) *exec.Cmd {
+	return CommandContext(ctx, name, args...)
+}
+
+// Start starts a command made by CommandContext or CommandContextGrace in a
+// new job object, which its child processes then inherit. The process is
+// created suspended and only resumed once it is in the job, so that none of
+// its children escape it.
+func Start(cmd *exec.Cmd) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return cmd.Start() // fall back to killing just the command
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+	// Cancel must not refer to cmd, or the finalizer would never run. It
+	// may also run before Start has returned.
+	var proc atomic.Pointer[os.Process]
+	var cancelled atomic.Bool
+	cmd.Cancel = func() error {
+		cancelled.Store(true)
+		windows.TerminateJobObject(job, 1)
+		if p := proc.Load(); p != nil {
+			// Kill the command itself in case it is not in the job.
+			return p.Kill()
+		}
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+	proc.Store(cmd.Process)
+	if cancelled.Load() {
+		cmd.Process.Kill()
+	}
+	runtime.SetFinalizer(cmd, func(*exec.Cmd) { windows.CloseHandle(job) })
+	if err := assignAndResume(job, uint32(cmd.Process.Pid)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// assignAndResume puts the suspended process pid in job and resumes it.
+func assignAndResume(job windows.Handle, pid uint32) error {
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, pid)
+	if err != nil {
+		return fmt.Errorf("cannot open process %d: %v", pid, err)
+	}
+	defer windows.CloseHandle(h)
+	if err := windows.AssignProcessToJobObject(job, h); err != nil {
+		return fmt.Errorf("cannot assign process %d to a job object: %v", pid, err)
+	}
+	// A new process has a single thread.
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return fmt.Errorf("cannot list the threads of process %d: %v", pid, err)
+	}
+	defer windows.CloseHandle(snap)
+	te := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	for err = windows.Thread32First(snap, &te); err == nil; err = windows.Thread32Next(snap, &te) {
+		if te.OwnerProcessID != pid {
+			continue
+		}
+		th, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, te.ThreadID)
+		if err != nil {
+			return fmt.Errorf("cannot resume process %d: %v", pid, err)
+		}
+		_, err = windows.ResumeThread(th)
+		windows.CloseHandle(th)
+		if err != nil {
+			return fmt.Errorf("cannot resume process %d: %v", pid, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot resume process %d: no thread found", pid)
+}
@@ -0,0 +1,247 @@
+// Package flakerun runs a command repeatedly, in parallel, until it fails.
+// It is the core of the flake command, for programs that want to find flaky
+// failures without shelling out to flake.
+//
+// It also has the helpers that flake uses to start each run: every command
+// runs in its own process group (a job object on Windows), so that stopping
+// it also stops any processes it left running.
+package flakerun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Runner runs a command repeatedly until a stop condition is met. The zero
+// values of the optional fields mean "no limit" or use a default.
+type Runner struct {
+	Command []string // the command line; required unless Exec is set
+	Env     []string // environment variables to add, as NAME=value
+	Dir     string   // working directory, if not the current one
+
+	Parallelism int // runs at a time; defaults to GOMAXPROCS
+
+	// GracePeriod is how long runs that are stopped early have to exit
+	// after SIGTERM before they are killed with SIGKILL. If it is zero,
+	// they are killed at once.
+	GracePeriod time.Duration
+
+	// Stop conditions. The runner also stops when the context passed to
+	// Run is done.
+	MaxRuns     int64         // runs, successful or not
+	MaxTime     time.Duration // wall-clock time
+	MaxFailures int           // failed runs; defaults to 1, and negative means no limit
+
+	// OnResult, if non-nil, is called with the result of each run as it
+	// finishes. Calls are made from a single goroutine, and the worker
+	// that made the run waits for OnResult to return before it starts
+	// another one, so OnResult can stop the runner (by cancelling the
+	// context passed to Run) without any further runs starting.
+	OnResult func(Result)
+
+	// Progress, if non-nil, is called every second with the summary so
+	// far, from the same goroutine as OnResult.
+	Progress func(Summary)
+
+	// Wait, if non-nil, is called by each worker before each run and may
+	// block to hold the run back (for example, while the machine is
+	// busy). If it returns an error, the worker stops.
+	Wait func(ctx context.Context, worker int) error
+
+	// Exec, if non-nil, makes run id in place of running Command, for
+	// callers that run commands their own way. It must return a Result
+	// with the given ID and worker. The runner discards the result if ctx
+	// is done by the time Exec returns.
+	Exec func(ctx context.Context, worker int, id int64) Result
+
+	lastID atomic.Int64
+}
+
+// A Result is the outcome of a single run.
+type Result struct {
+	ID      int64 // runs are numbered from 1 in the order they start
+	Worker  int   // numbered from 1
+	Start   time.Time
+	Elapsed time.Duration
+	// Err is nil if the run succeeded. Otherwise it is the error from
+	// exec.Cmd.Wait, usually an *exec.ExitError.
+	Err error
+	// Output is the combined stdout and stderr of a failed run.
+	Output []byte
+	// Value is for the caller's own use: Exec can use it to pass more
+	// about the run to OnResult.
+	Value any
+}
+
+// A Summary describes a session.
+type Summary struct {
+	Passed int64 // number of successful runs
+	Failed int64 // number of failed runs
+	// Failures are the failed runs, in the order they finished. Only the
+	// first MaxFailures are kept, and none if there is no limit (use
+	// OnResult to see them all).
+	Failures  []Result
+	Elapsed   time.Duration
+	OutOfTime bool // the runner stopped at MaxTime
+}
+
+// NextID returns a new run ID, for callers that make runs of their own (such
+// as reruns of a failure) and want them numbered along with the runner's.
+func (r *Runner) NextID() int64 {
+	return r.lastID.Add(1)
+}
+
+// Run runs the command until a stop condition is met and returns a summary.
+// Runs that are still in progress at that point are killed and not counted.
+// Run returns an error (and no summary) only if the command cannot be
+// started at all.
+func (r *Runner) Run(ctx context.Context) (*Summary, error) {
+	run := r.Exec
+	if run == nil {
+		if len(r.Command) == 0 {
+			return nil, errors.New("flakerun: no command")
+		}
+		path, err := exec.LookPath(r.Command[0])
+		if err != nil {
+			return nil, err
+		}
+		run = func(ctx context.Context, worker int, id int64) Result {
+			return r.run(ctx, worker, id, path)
+		}
+	}
+	parallelism := r.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	maxFailures := r.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = 1
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var maxTimeC <-chan time.Time
+	if r.MaxTime > 0 {
+		t := time.NewTimer(r.MaxTime)
+		defer t.Stop()
+		maxTimeC = t.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	type outcome struct {
+		res  Result
+		done chan struct{} // closed once the result is handled
+	}
+	outcomes := make(chan outcome)
+	var wg sync.WaitGroup
+	for worker := 1; worker <= parallelism; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if r.Wait != nil {
+					if err := r.Wait(ctx, worker); err != nil {
+						return
+					}
+				}
+				res := run(ctx, worker, r.NextID())
+				if ctx.Err() != nil {
+					return // killed because the session is over
+				}
+				o := outcome{res: res, done: make(chan struct{})}
+				select {
+				case outcomes <- o:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case <-o.done:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var sum Summary
+	var startErr error
+loop:
+	for {
+		select {
+		case o := <-outcomes:
+			if err, ok := o.res.Err.(startError); ok {
+				startErr = err.err
+				break loop
+			}
+			if o.res.Err != nil {
+				sum.Failed++
+				if maxFailures > 0 && len(sum.Failures) < maxFailures {
+					sum.Failures = append(sum.Failures, o.res)
+				}
+			} else {
+				sum.Passed++
+			}
+			if r.OnResult != nil {
+				r.OnResult(o.res)
+			}
+			if ctx.Err() != nil ||
+				maxFailures > 0 && sum.Failed >= int64(maxFailures) ||
+				r.MaxRuns > 0 && sum.Passed+sum.Failed >= r.MaxRuns {
+				break loop
+			}
+			close(o.done)
+		case <-ticker.C:
+			if r.Progress != nil {
+				sum.Elapsed = time.Since(start)
+				r.Progress(sum)
+			}
+		case <-maxTimeC:
+			sum.OutOfTime = true
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	cancel()
+	wg.Wait()
+	if startErr != nil {
+		return nil, startErr
+	}
+	sum.Elapsed = time.Since(start)
+	return &sum, nil
+}
+
+// A startError is the Err of a Result for a command that could not be
+// started.
+type startError struct{ err error }
+
+func (e startError) Error() string { return e.err.Error() }
+
+// run runs r.Command, found at path, as run id.
+func (r *Runner) run(ctx context.Context, worker int, id int64, path string) Result {
+	res := Result{ID: id, Worker: worker, Start: time.Now()}
+	var out bytes.Buffer
+	cmd := CommandContextGrace(ctx, r.GracePeriod, path, r.Command[1:]...)
+	cmd.Env = append(cmd.Environ(), r.Env...)
+	cmd.Dir = r.Dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := Start(cmd); err != nil {
+		res.Err = startError{err}
+		return res
+	}
+	res.Err = cmd.Wait()
+	res.Elapsed = time.Since(res.Start)
+	if res.Err != nil {
+		res.Output = out.Bytes()
+	}
+	return res
+}
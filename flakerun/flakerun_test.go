@@ -0,0 +1,179 @@
+package flakerun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+// When the test binary is run with helperEnv set, it acts as the command
+// under test instead of running the tests.
+const helperEnv = "FLAKERUN_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "ok":
+		os.Exit(0)
+	case "exit3":
+		fmt.Println("failing")
+		os.Exit(3)
+	case "sleep":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(2)
+}
+
+func helper(ctx context.Context, t *testing.T, mode string) *exec.Cmd {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := CommandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), helperEnv+"="+mode)
+	return cmd
+}
+
+func TestStart(t *testing.T) {
+	cmd := helper(context.Background(), t, "exit3")
+	if err := Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	err := cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 3 {
+		t.Fatalf("Wait: got %v; want exit status 3", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := helper(ctx, t, "sleep")
+	if err := Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := cmd.Wait(); err == nil {
+		t.Fatal("Wait succeeded after cancelling")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("command took %s to stop after cancelling", elapsed)
+	}
+}
+
+// helperRunner returns a Runner that runs the test binary in the given mode.
+func helperRunner(t *testing.T, mode string) *Runner {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Runner{Command: []string{exe}, Env: []string{helperEnv + "=" + mode}, Parallelism: 2}
+}
+
+func TestRunnerStopsAtFailure(t *testing.T) {
+	r := helperRunner(t, "exit3")
+	sum, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Failed != 1 || len(sum.Failures) != 1 {
+		t.Fatalf("got %d failures (%d kept); want 1", sum.Failed, len(sum.Failures))
+	}
+	f := sum.Failures[0]
+	if ee, ok := f.Err.(*exec.ExitError); !ok || ee.ExitCode() != 3 {
+		t.Errorf("Err: got %v; want exit status 3", f.Err)
+	}
+	if got := string(f.Output); got != "failing\n" {
+		t.Errorf("Output: got %q; want %q", got, "failing\n")
+	}
+}
+
+func TestRunnerMaxRuns(t *testing.T) {
+	r := helperRunner(t, "ok")
+	r.MaxRuns = 5
+	var results int
+	r.OnResult = func(Result) { results++ }
+	sum, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Passed != 5 || sum.Failed != 0 || results != 5 {
+		t.Fatalf("got %d passed, %d failed, %d results; want 5, 0, 5", sum.Passed, sum.Failed, results)
+	}
+}
+
+func TestRunnerMaxTime(t *testing.T) {
+	r := helperRunner(t, "sleep")
+	r.MaxTime = 200 * time.Millisecond
+	sum, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sum.OutOfTime || sum.Passed != 0 || sum.Failed != 0 {
+		t.Fatalf("got %+v; want OutOfTime and no runs", sum)
+	}
+}
+
+func TestRunnerNoCommand(t *testing.T) {
+	if _, err := (&Runner{}).Run(context.Background()); err == nil {
+		t.Error("Run with no command succeeded")
+	}
+	r := &Runner{Command: []string{"flakerun-no-such-command"}}
+	if _, err := r.Run(context.Background()); err == nil {
+		t.Error("Run with a missing command succeeded")
+	}
+}
+
+func TestRunnerExec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var waits, execs int
+	r := &Runner{
+		Parallelism: 1,
+		MaxFailures: -1,
+		Wait: func(ctx context.Context, worker int) error {
+			waits++
+			return nil
+		},
+		Exec: func(ctx context.Context, worker int, id int64) Result {
+			execs++
+			var err error
+			if id%2 == 0 {
+				err = errors.New("even")
+			}
+			return Result{ID: id, Worker: worker, Err: err, Value: fmt.Sprint("run ", id)}
+		},
+	}
+	var values []any
+	r.OnResult = func(res Result) {
+		values = append(values, res.Value)
+		if len(values) == 4 {
+			cancel() // stop without starting another run
+		}
+	}
+	sum, err := r.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waits != 4 || execs != 4 {
+		t.Errorf("got %d waits and %d runs; want 4 of each", waits, execs)
+	}
+	if want := []any{"run 1", "run 2", "run 3", "run 4"}; !slices.Equal(values, want) {
+		t.Errorf("got values %q; want %q", values, want)
+	}
+	if sum.Passed != 2 || sum.Failed != 2 || len(sum.Failures) != 0 {
+		t.Errorf("got %d passed, %d failed, %d kept; want 2, 2, 0", sum.Passed, sum.Failed, len(sum.Failures))
+	}
+	if id := r.NextID(); id != 5 {
+		t.Errorf("NextID after 4 runs: got %d; want 5", id)
+	}
+}
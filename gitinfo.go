@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// A gitState describes the code in the current directory's git repository.
+type gitState struct {
+	commit string
+	branch string // or "HEAD" if detached
+	dirty  bool   // uncommitted changes
+}
+
+// currentGitState returns the state of the git repository containing the
+// current directory, or nil if there is none (or git is not installed).
+func currentGitState() *gitState {
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", args...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil
+	}
+	gs := &gitState{commit: commit}
+	gs.branch, _ = git("rev-parse", "--abbrev-ref", "HEAD")
+	status, err := git("status", "--porcelain", "--untracked-files=no")
+	gs.dirty = err == nil && status != ""
+	return gs
+}
+
+func (gs *gitState) String() string {
+	s := fmt.Sprintf("%s (branch %s", gs.commit, gs.branch)
+	if gs.dirty {
+		s += ", with uncommitted changes"
+	}
+	return s + ")"
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A goTest is a 'go test' command line for a single package, split into the
+// parts that go to the build and the parts that go to the test binary.
+type goTest struct {
+	goTool string
+	env    []string
+	build  []string // build flags
+	pkg    string
+	// importPath is the package's import path, set by compile.
+	importPath string
+	testArgs   []string // flags for the test binary, as -test.name
+}
+
+// Flags of go test that take a value (in the next word if not given with =).
+// Other flags are booleans.
+var (
+	goTestBinaryFlags = map[string]bool{
+		"bench": true, "benchtime": true, "blockprofile": true,
+		"blockprofilerate": true, "count": true, "coverprofile": true,
+		"cpu": true, "cpuprofile": true, "fuzz": true, "fuzzminimizetime": true,
+		"fuzztime": true, "list": true, "memprofile": true,
+		"memprofilerate": true, "mutexprofile": true,
+		"mutexprofilefraction": true, "outputdir": true, "parallel": true,
+		"run": true, "shuffle": true, "skip": true, "timeout": true,
+		"trace": true,
+	}
+	goTestBinaryBoolFlags = map[string]bool{
+		"benchmem": true, "failfast": true, "fullpath": true, "short": true,
+		"v": true,
+	}
+	goBuildFlags = map[string]bool{
+		"asmflags": true, "buildmode": true, "compiler": true,
+		"covermode": true, "coverpkg": true, "exec": true, "gccgoflags": true,
+		"gcflags": true, "installsuffix": true, "ldflags": true, "mod": true,
+		"modfile": true, "overlay": true, "p": true, "pgo": true, "pkgdir": true,
+		"tags": true, "toolexec": true, "vet": true,
+	}
+)
+
+// parseGoTest parses c as 'go test [flags] [package] [flags] [-args ...]'.
+func parseGoTest(c *command) (*goTest, error) {
+	if len(c.args) < 2 || filepath.Base(c.args[0]) != "go" || c.args[1] != "test" {
+		return nil, errors.New("the command is not 'go test'")
+	}
+	gt := &goTest{goTool: c.args[0], env: c.env}
+	args := c.args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" || arg == "--args" {
+			gt.testArgs = append(gt.testArgs, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			if gt.pkg != "" {
+				return nil, errors.New("more than one package")
+			}
+			gt.pkg = arg
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		name = strings.TrimPrefix(name, "test.")
+		words := []string{arg}
+		if !hasValue && (goTestBinaryFlags[name] || goBuildFlags[name]) {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag %s needs a value", arg)
+			}
+			i++
+			words = append(words, args[i])
+		}
+		switch {
+		case name == "json":
+			return nil, errors.New("-json is not supported")
+		case name == "c" || name == "o" || name == "exec":
+			return nil, fmt.Errorf("%s is not supported", arg)
+		case goTestBinaryFlags[name] || goTestBinaryBoolFlags[name]:
+			words[0] = "-test." + strings.TrimPrefix(strings.TrimLeft(words[0], "-"), "test.")
+			gt.testArgs = append(gt.testArgs, words...)
+		default:
+			gt.build = append(gt.build, words...)
+		}
+	}
+	if gt.pkg == "" {
+		gt.pkg = "."
+	}
+	return gt, nil
+}
+
+// test2json returns a version of c, a command that runs the compiled test
+// binary, that runs it under test2json as go test -json would.
+func (gt *goTest) test2json(c *command) *command {
+	args := []string{gt.goTool, "tool", "test2json", "-p", gt.importPath, c.args[0], "-test.v=test2json"}
+	for _, arg := range c.args[1:] {
+		if arg != "-test.v" && !strings.HasPrefix(arg, "-test.v=") {
+			args = append(args, arg)
+		}
+	}
+	return &command{args: args, env: c.env, dir: c.dir}
+}
+
+// compile builds the test binary into dir and returns the command that runs
+// it as go test would: in the package's directory, with go test's default
+// timeout.
+func (gt *goTest) compile(dir string) (*command, error) {
+	var stderr bytes.Buffer
+	list := exec.Command(gt.goTool, "list", "-f", "{{.ImportPath}}\t{{.Dir}}", gt.pkg)
+	list.Env = append(list.Environ(), gt.env...)
+	list.Stderr = &stderr
+	out, err := list.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list %s: %s\n%s", gt.pkg, err, stderr.Bytes())
+	}
+	listed := strings.TrimSpace(string(out))
+	if strings.Contains(listed, "\n") {
+		return nil, fmt.Errorf("%s matches more than one package", gt.pkg)
+	}
+	importPath, pkgDir, _ := strings.Cut(listed, "\t")
+	gt.importPath = importPath
+	binary := filepath.Join(dir, "pkg.test")
+	args := append([]string{"test", "-c", "-o", binary}, gt.build...)
+	build := exec.Command(gt.goTool, append(args, gt.pkg)...)
+	build.Env = append(build.Environ(), gt.env...)
+	if out, err := build.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("go test -c: %s\n%s", err, out)
+	}
+	if _, err := os.Stat(binary); err != nil {
+		return nil, fmt.Errorf("%s has no tests", gt.pkg)
+	}
+	argv := []string{binary, "-test.paniconexit0"}
+	hasTimeout := slices.ContainsFunc(gt.testArgs, func(arg string) bool {
+		return strings.HasPrefix(arg, "-test.timeout")
+	})
+	if !hasTimeout {
+		argv = append(argv, "-test.timeout=10m0s")
+	}
+	return &command{args: append(argv, gt.testArgs...), env: gt.env, dir: pkgDir}, nil
+}
+
+// removeTestFlag removes the test binary flag name (such as "run") from
+// gt.testArgs and returns its last value, or "" if it was not set.
+func (gt *goTest) removeTestFlag(name string) string {
+	var value string
+	var args []string
+	for i := 0; i < len(gt.testArgs); i++ {
+		arg := gt.testArgs[i]
+		n, v, hasValue := strings.Cut(arg, "=")
+		if n != "-test."+name {
+			args = append(args, arg)
+			continue
+		}
+		switch {
+		case hasValue:
+			value = v
+		case goTestBinaryFlags[name] && i+1 < len(gt.testArgs):
+			i++
+			value = gt.testArgs[i]
+		default:
+			value = "true"
+		}
+	}
+	gt.testArgs = args
+	return value
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// historyFlags returns the flag set of flake history, which has only a usage
+// message.
+func historyFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("flake history", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake history diff <before> <after>
+
+Flake history diff compares two sessions of the same command recorded with
+flake -json (such as before and after a fix) without rerunning anything: it
+reports each session's failure rate with a 95% confidence interval, how the
+rate changed, and whether the change is statistically significant.
+`)
+	}
+	return fs
+}
+
+func historyMain(args []string) {
+	fs := historyFlags()
+	fs.Parse(args)
+	if fs.NArg() != 3 || fs.Arg(0) != "diff" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var sessions [2]*mergedSession
+	for i, name := range fs.Args()[1:] {
+		var signatures failureSignatures
+		s, err := readSession(name, &signatures)
+		if err != nil {
+			log.Fatalln("Cannot read events:", err)
+		}
+		if s.passed+s.failures == 0 {
+			log.Fatalf("No runs finished in %s", name)
+		}
+		if !s.ended {
+			log.Printf("Warning: %s did not finish", name)
+		}
+		sessions[i] = s
+	}
+	before, after := sessions[0], sessions[1]
+	if before.code != after.code {
+		log.Printf("Code: %s -> %s", orDash(before.code), orDash(after.code))
+	}
+	for _, s := range sessions {
+		runs := s.passed + s.failures
+		lower, upper := wilsonInterval(s.failures, runs, 1.96)
+		log.Printf("%s: %d failure(s) in %d run(s): rate %.3g%% (95%% confidence interval %.3g%% to %.3g%%)",
+			s.name, s.failures, runs, 100*float64(s.failures)/float64(runs), 100*lower, 100*upper)
+	}
+	beforeRuns, afterRuns := before.passed+before.failures, after.passed+after.failures
+	beforeRate := float64(before.failures) / float64(beforeRuns)
+	afterRate := float64(after.failures) / float64(afterRuns)
+	change := "unchanged"
+	switch {
+	case beforeRate == 0 && afterRate > 0:
+		change = "up from zero"
+	case beforeRate > 0:
+		change = fmt.Sprintf("%+.3g%%", 100*(afterRate-beforeRate)/beforeRate)
+	}
+	log.Printf("Change: %.3g%% -> %.3g%% (%s)", 100*beforeRate, 100*afterRate, change)
+	p := fisherExact(after.failures, afterRuns, before.failures, beforeRuns)
+	switch {
+	case p >= 0.05:
+		log.Printf("The difference is not statistically significant (p = %.2g); more runs may tell.", p)
+	case afterRate < beforeRate:
+		log.Printf("Failures are significantly less likely in %s (p = %.2g).", after.name, p)
+	default:
+		log.Printf("Failures are significantly more likely in %s (p = %.2g).", after.name, p)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
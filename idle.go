@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// An activityWriter counts the bytes written through it.
+type activityWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (aw *activityWriter) Write(p []byte) (int, error) {
+	aw.n.Add(int64(len(p)))
+	return aw.w.Write(p)
+}
+
+// clockTick is the unit of the CPU times reported in /proc.
+const clockTick = 10 * time.Millisecond
+
+// watchIdle calls kill if, for a period of d, the processes in group pgid
+// use (almost) no CPU time and write no output to out. It returns when ctx
+// is done or after calling kill.
+func watchIdle(ctx context.Context, pgid int, out *activityWriter, d time.Duration, kill func()) {
+	// Allow 1% CPU usage for things like runtime timers and GC.
+	maxTicks := uint64(d / 100 / clockTick)
+	ticker := time.NewTicker(max(min(d/4, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+
+	idleSince := time.Now()
+	baseCPU := groupCPU(pgid)
+	baseOut := out.n.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cpu, n := groupCPU(pgid), out.n.Load()
+		// CPU time can also go down as processes exit.
+		if n != baseOut || cpu < baseCPU || cpu-baseCPU > maxTicks {
+			idleSince, baseCPU, baseOut = time.Now(), cpu, n
+			continue
+		}
+		if time.Since(idleSince) >= d {
+			kill()
+			return
+		}
+	}
+}
+
+func groupCPU(pgid int) uint64 {
+	var ticks uint64
+	for _, p := range groupProcs(pgid) {
+		ticks += p.cpuTicks
+	}
+	return ticks
+}
+
+// heartbeatFile returns the name to use for $FLAKE_HEARTBEAT for run id,
+// which uses tmpdir if it is nonempty.
+func heartbeatFile(id int64, tmpdir string) string {
+	if tmpdir != "" {
+		return filepath.Join(tmpdir, "flake-heartbeat")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("flake-heartbeat-%d-%d", os.Getpid(), id))
+}
+
+// watchHeartbeat calls kill if the file name is not modified for a period of
+// d. It returns when ctx is done or after calling kill.
+func watchHeartbeat(ctx context.Context, name string, d time.Duration, kill func()) {
+	ticker := time.NewTicker(max(min(d/4, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// If the run removed the file, count from the last beat seen.
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+		if time.Since(last) >= d {
+			kill()
+			return
+		}
+	}
+}
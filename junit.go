@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Output  string `xml:",chardata"`
+}
+
+// writeJUnit writes a JUnit XML report of a session that started at start
+// and ran cmd to the file name. The passing runs are summarized as a single
+// test case; each failure kept (of failCount in all) is a failed test case
+// with the run's output, and the rest are summarized as one more.
+func writeJUnit(name string, cmd *command, code *gitState, start time.Time, passed int64, passedTime time.Duration, failures []runResult, failCount int64) error {
+	suite := junitSuite{
+		Name:      cmd.String(),
+		Time:      time.Since(start).Seconds(),
+		Timestamp: start.Format("2006-01-02T15:04:05"),
+	}
+	if code != nil {
+		suite.Properties = []junitProperty{
+			{Name: "git.commit", Value: code.commit},
+			{Name: "git.branch", Value: code.branch},
+			{Name: "git.dirty", Value: strconv.FormatBool(code.dirty)},
+		}
+	}
+	suite.Cases = append(suite.Cases, junitCase{
+		Name:      "passing runs",
+		Classname: "flake",
+		Time:      passedTime.Seconds(),
+		SystemOut: fmt.Sprintf("%d iteration(s) passed\n", passed),
+	})
+	for _, r := range failures {
+		f := &junitFailure{Message: r.err.Error(), Type: "error"}
+		if re, ok := r.err.(*runError); ok {
+			f.Type = "failure"
+			f.Output = string(re.output)
+		}
+		suite.Cases = append(suite.Cases, junitCase{
+			Name:      fmt.Sprintf("run %d", r.id),
+			Classname: "flake",
+			Time:      r.elapsed.Seconds(),
+			Failure:   f,
+		})
+	}
+	if more := failCount - int64(len(failures)); more > 0 {
+		suite.Cases = append(suite.Cases, junitCase{
+			Name:      "other failed runs",
+			Classname: "flake",
+			Failure: &junitFailure{
+				Message: fmt.Sprintf("%d more run(s) failed (flake keeps the details of the first -failures)", more),
+				Type:    "failure",
+			},
+		})
+	}
+	suite.Tests = len(suite.Cases)
+	suite.Failures = len(suite.Cases) - 1
+	b, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{suite}}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append([]byte(xml.Header), append(b, '\n')...), 0o644)
+}
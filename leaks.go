@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type procInfo struct {
+	pid      int
+	cmdline  string
+	zombie   bool
+	cpuTicks uint64 // user and system time, including waited-for children
+	rss      int64  // resident set size in bytes
+}
+
+// A leakAudit records processes that were left behind by runs that have
+// otherwise exited. Each run is started in its own process group, so any
+// process still in that group after the run finishes has leaked.
+type leakAudit struct {
+	mu      sync.Mutex
+	runs    int
+	procs   int
+	zombies int
+	samples []string
+}
+
+const maxLeakSamples = 5
+
+func (a *leakAudit) check(id int64, pgid int) {
+	procs := groupProcs(pgid)
+	if len(procs) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runs++
+	for _, p := range procs {
+		a.procs++
+		if p.zombie {
+			a.zombies++
+		}
+		if len(a.samples) < maxLeakSamples {
+			s := fmt.Sprintf("run %d: pid %d: %s", id, p.pid, p.cmdline)
+			if p.zombie {
+				s += " (zombie)"
+			}
+			a.samples = append(a.samples, s)
+		}
+	}
+}
+
+func (a *leakAudit) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.procs == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d process(es) leaked by %d run(s)", a.procs, a.runs)
+	if a.zombies > 0 {
+		fmt.Fprintf(&b, " (%d zombie)", a.zombies)
+	}
+	b.WriteString(":")
+	for _, s := range a.samples {
+		b.WriteString("\n  ")
+		b.WriteString(s)
+	}
+	if n := a.procs - len(a.samples); n > 0 {
+		fmt.Fprintf(&b, "\n  ...and %d more", n)
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memAdmission delays starting runs while available system memory is low.
+// It allows for the largest peak RSS of any run seen so far, so that a new
+// run is only started if it would (probably) still leave minFree bytes
+// available.
+//
+// A run that was just started has not used its memory yet, so each admitted
+// run also holds back that much until it finishes, less what its processes
+// already use (which is no longer available), so that a run's memory is
+// only counted once. Where the RSS of running processes is unknown (see
+// groupProcs), runs that have grown are counted twice, which errs on the
+// side of starting fewer runs.
+type memAdmission struct {
+	minFree int64
+
+	mu       sync.Mutex // held while checking, so runs are admitted one at a time
+	maxRSS   int64
+	admitted int          // runs that wait admitted and release has not yet released
+	running  map[int]bool // process groups of the admitted runs that have started
+	low      bool         // whether the most recent check found too little memory
+}
+
+const memPollInterval = 500 * time.Millisecond
+
+// wait waits until there is enough memory to start a run and admits it.
+// The caller must call release when the run finishes.
+func (m *memAdmission) wait(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		avail, err := memAvailable()
+		if err != nil {
+			// Checked up front; don't hold up the session.
+			m.admitted++
+			m.mu.Unlock()
+			return nil
+		}
+		// The memory the running runs use counts against what they
+		// hold back, up to the most that a run uses.
+		for pgid := range m.running {
+			var rss int64
+			for _, p := range groupProcs(pgid) {
+				rss += p.rss
+			}
+			avail += min(rss, m.maxRSS)
+		}
+		m.low = avail < m.minFree+m.maxRSS*int64(m.admitted+1)
+		low := m.low
+		if !low {
+			m.admitted++
+		}
+		m.mu.Unlock()
+		if !low {
+			return nil
+		}
+		select {
+		case <-time.After(memPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release releases the memory held back for a run that wait admitted.
+func (m *memAdmission) release() {
+	m.mu.Lock()
+	m.admitted--
+	m.mu.Unlock()
+}
+
+// started records that an admitted run started as process group pgid.
+func (m *memAdmission) started(pgid int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running == nil {
+		m.running = make(map[int]bool)
+	}
+	m.running[pgid] = true
+}
+
+// exited records that the run in process group pgid exited.
+func (m *memAdmission) exited(pgid int) {
+	m.mu.Lock()
+	delete(m.running, pgid)
+	m.mu.Unlock()
+}
+
+func (m *memAdmission) isLow() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.low
+}
+
+// observe records the peak RSS of a finished run.
+func (m *memAdmission) observe(rss int64) {
+	m.mu.Lock()
+	m.maxRSS = max(m.maxRSS, rss)
+	m.mu.Unlock()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// A mergedSession is the summary of one -json event stream. Runs that ended
+// in an error, or in an unconfirmed or ignored failure, are not counted in
+// passed and failures.
+type mergedSession struct {
+	name     string
+	passed   int64
+	failures int64
+	code     string // from the end event
+	seed     uint64 // from the end event
+	ended    bool
+
+	started     int64 // runs
+	errors      int64
+	unconfirmed int64
+	ignored     int64
+	cancelled   int64
+	first, last time.Time // of the events
+
+	passing  durationSample
+	failing  []time.Duration
+	examples map[string]*jsonEvent // the first failure with each signature
+}
+
+// readSession reads the -json event stream in the named file, adding its
+// failures to signatures.
+func readSession(name string, signatures *failureSignatures) (*mergedSession, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &mergedSession{name: filepath.Base(name), examples: make(map[string]*jsonEvent)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var ev jsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err)
+		}
+		if s.first.IsZero() {
+			s.first = ev.Time
+		}
+		s.last = ev.Time
+		elapsed := time.Duration(ev.Elapsed * float64(time.Second))
+		switch ev.Event {
+		case "start":
+			s.started++
+		case "finish":
+			switch ev.Result {
+			case "pass":
+				s.passed++
+				s.passing.add(elapsed)
+			case "fail":
+				s.failures++
+				s.failing = append(s.failing, elapsed)
+				sig := outputSignature(ev.Error, []byte(ev.Output))
+				signatures.add(sig, fmt.Sprintf("%s:%d", s.name, ev.Run))
+				if s.examples[sig] == nil {
+					s.examples[sig] = &ev
+				}
+			case "error":
+				s.errors++
+			case "unconfirmed":
+				s.unconfirmed++
+			case "ignored":
+				s.ignored++
+			case "cancelled":
+				s.cancelled++
+			}
+		case "end":
+			s.code = ev.Code
+			s.seed = ev.Seed
+			s.ended = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mergeReportFlags defines the flags of flake merge-report.
+func mergeReportFlags() (fs *flag.FlagSet, similarity *float64) {
+	fs = flag.NewFlagSet("flake merge-report", flag.ExitOnError)
+	similarity = fs.Float64("similarity", defaultSimilarity, "Show failure signatures that are at least this similar (from 0\nto 1) together; 0 shows each signature on its own")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake merge-report [flags...] <file>...
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+
+Flake merge-report combines the event streams written by flake -json in
+several sessions (such as on several machines hunting the same flake) into
+one report: the runs and failures of each session, the failure rate of all of
+them together with a 95% confidence interval, and the failures of all the
+sessions grouped by signature.
+`)
+	}
+	return fs, similarity
+}
+
+func mergeReportMain(args []string) {
+	fs, similarity := mergeReportFlags()
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *similarity < 0 || *similarity > 1 {
+		log.Fatalln("-similarity must be between 0 and 1")
+	}
+	var (
+		sessions []*mergedSession
+		passed   int64
+		failures int64
+	)
+	signatures := failureSignatures{similarity: *similarity}
+	for _, name := range fs.Args() {
+		s, err := readSession(name, &signatures)
+		if err != nil {
+			log.Fatalln("Cannot read events:", err)
+		}
+		sessions = append(sessions, s)
+		passed += s.passed
+		failures += s.failures
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tRUNS\tFAILURES\tRATE\tCODE")
+	codes := make(map[string]bool)
+	for _, s := range sessions {
+		runs := s.passed + s.failures
+		rate := "-"
+		if runs > 0 {
+			rate = fmt.Sprintf("%.3g%%", 100*float64(s.failures)/float64(runs))
+		}
+		code := s.code
+		if !s.ended {
+			code = "(did not finish)"
+		} else if code == "" {
+			code = "-"
+		}
+		codes[s.code] = true
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", s.name, runs, s.failures, rate, code)
+	}
+	tw.Flush()
+	if len(codes) > 1 {
+		log.Print("Warning: the sessions did not all run the same code")
+	}
+	runs := passed + failures
+	if runs == 0 {
+		log.Print("No runs finished")
+		return
+	}
+	lower, upper := wilsonInterval(failures, runs, 1.96)
+	log.Printf("Total: %d failure(s) in %d run(s): rate %.3g%% (95%% confidence interval %.3g%% to %.3g%%)",
+		failures, runs, 100*float64(failures)/float64(runs), 100*lower, 100*upper)
+	if failures > 0 {
+		signatures.report()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var failLineRx = regexp.MustCompile(`(?m)^\s*--- FAIL: (\S+)`)
+
+// failedTest returns the full name of a test (the innermost subtest) that
+// failed in re, or "" if no test is known to have failed.
+func failedTest(re *runError) string {
+	if len(re.tests) > 0 {
+		return re.tests[0].test
+	}
+	// go test prints a failed test before its failed subtests.
+	var name string
+	for _, m := range failLineRx.FindAllSubmatch(re.output, -1) {
+		test := string(m[1])
+		if name != "" && !strings.HasPrefix(test, name+"/") {
+			break
+		}
+		name = test
+	}
+	return name
+}
+
+// runPattern returns a -run pattern that matches only the named test.
+func runPattern(test string) string {
+	parts := strings.Split(test, "/")
+	for i, part := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(part) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+// narrowGoTest returns a version of c that runs only the named test. The
+// command is 'go test', a compiled test binary, or a test binary run by
+// test2json (see goTest).
+func narrowGoTest(c *command, test string) *command {
+	var args []string
+	for i := 0; i < len(c.args); i++ {
+		arg := c.args[i]
+		if arg == "-args" || arg == "--args" {
+			args = append(args, c.args[i:]...)
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if i > 0 && strings.HasPrefix(arg, "-") && strings.TrimPrefix(name, "test.") == "run" {
+			if !hasValue {
+				i++
+			}
+			continue
+		}
+		args = append(args, arg)
+	}
+	// Put the flag before any positional arguments.
+	flagName, at := "-test.run", 1
+	if len(args) > 1 && args[1] == "test" {
+		flagName, at = "-run", 2
+	} else if len(args) > 2 && filepath.Base(args[0]) == "go" && args[2] == "test2json" {
+		at = slices.Index(args, "-test.v=test2json") + 1
+	}
+	args = append(args[:at:at], append([]string{flagName + "=" + runPattern(test)}, args[at:]...)...)
+	return &command{args: args, env: c.env, dir: c.dir, wrapper: c.wrapper}
+}
+
+// runIsolated runs rc n times on workers in parallel and returns how many
+// runs finished (fewer than n if ctx is canceled) and how many of them
+// failed.
+func runIsolated(ctx context.Context, workers []*worker, rc runConfig, n int64, nextID func() int64) (runs, failures int64) {
+	var (
+		started atomic.Int64
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for _, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for started.Add(1) <= n {
+				err := w.run(ctx, nextID(), rc)
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				runs++
+				if err != nil {
+					failures++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return runs, failures
+}
+
+// narrowReport compares the failure rate of test run in isolation with the
+// failure rate of the full package.
+func narrowReport(test string, pkgFailures, pkgRuns, failures, runs int64) string {
+	rate := func(failures, runs int64) string {
+		if runs == 0 {
+			return fmt.Sprintf("%d/0", failures)
+		}
+		return fmt.Sprintf("%d/%d (%.2f%%)", failures, runs, 100*float64(failures)/float64(runs))
+	}
+	s := fmt.Sprintf("Failure rate: %s with the full package, %s with %s alone", rate(pkgFailures, pkgRuns), rate(failures, runs), test)
+	expected := float64(pkgFailures) / float64(pkgRuns) * float64(runs)
+	switch {
+	case runs == 0:
+	case failures > 0:
+		s += "\nIt fails in isolation too, so the flakiness is in the test itself"
+	case expected < 3:
+		s += fmt.Sprintf("\nIt did not fail in isolation, but that is not conclusive: the full-package\nrate would predict only %.1f failure(s) in %d run(s) (use a larger -narrow)", expected, runs)
+	default:
+		s += "\nIt did not fail in isolation, so it probably fails because of interference\nfrom other tests in the package (shared state, ordering, or parallelism)"
+	}
+	return s
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// An orderSearch looks for tests of a package that fail only when they run
+// after certain other tests. It relies on go test -shuffle shuffling the
+// package's whole list of tests before -run selects some of them, so that
+// with the same seed any subset of the tests runs in the same relative order.
+type orderSearch struct {
+	cmd     *command // the compiled test binary
+	run     string   // the -run pattern from the command line, if any
+	workers []*worker
+	id      atomic.Int64
+}
+
+var runLineRx = regexp.MustCompile(`(?m)^=== RUN   ([^/\s]+)$`)
+
+// command returns the command that runs the tests (or, if tests is nil, the
+// tests selected by the command line) verbosely in the order given by seed.
+func (o *orderSearch) command(seed int64, tests []string) *command {
+	flags := []string{"-test.v=true", "-test.shuffle=" + strconv.FormatInt(seed, 10)}
+	switch {
+	case tests != nil:
+		flags = append(flags, "-test.run="+testsPattern(tests))
+	case o.run != "":
+		flags = append(flags, "-test.run="+o.run)
+	}
+	args := slices.Concat(o.cmd.args[:1], flags, o.cmd.args[1:])
+	return &command{args: args, env: o.cmd.env, dir: o.cmd.dir}
+}
+
+// testsPattern returns a -run pattern that matches exactly the named
+// top-level tests.
+func testsPattern(tests []string) string {
+	quoted := make([]string, len(tests))
+	for i, test := range tests {
+		quoted[i] = regexp.QuoteMeta(test)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// each runs the command for seed and tests up to n times on the workers,
+// calling f (serially) with the result of each run until f returns false.
+func (o *orderSearch) each(ctx context.Context, seed func() int64, tests []string, n int64, f func(seed int64, err error) bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		started atomic.Int64
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	for _, w := range o.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for started.Add(1) <= n {
+				s := seed()
+				err := w.run(ctx, o.id.Add(1), runConfig{cmd: o.command(s, tests)})
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				if !f(s, err) {
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// failedTests returns the top-level tests that failed in a run.
+func failedTests(err error) []string {
+	re, ok := err.(*runError)
+	if !ok {
+		return nil
+	}
+	var tests []string
+	for _, m := range failLineRx.FindAllSubmatch(re.output, -1) {
+		test, _, _ := strings.Cut(string(m[1]), "/")
+		if !slices.Contains(tests, test) {
+			tests = append(tests, test)
+		}
+	}
+	return tests
+}
+
+// fails reports whether victim fails in any of n runs of tests (which include
+// victim) with the given seed, stopping at the first failure.
+func (o *orderSearch) fails(ctx context.Context, seed int64, tests []string, victim string, n int64) bool {
+	var failed bool
+	o.each(ctx, func() int64 { return seed }, tests, n, func(_ int64, err error) bool {
+		failed = slices.Contains(failedTests(err), victim)
+		return !failed
+	})
+	return failed
+}
+
+// failures returns how many of n runs of tests with the given seed victim
+// fails in.
+func (o *orderSearch) failures(ctx context.Context, seed int64, tests []string, victim string, n int64) int64 {
+	var failures int64
+	o.each(ctx, func() int64 { return seed }, tests, n, func(_ int64, err error) bool {
+		if slices.Contains(failedTests(err), victim) {
+			failures++
+		}
+		return true
+	})
+	return failures
+}
+
+// orderFlags defines the flags of flake order.
+func orderFlags() (fs *flag.FlagSet, runs, tries *int64, parallelism *int) {
+	fs = flag.NewFlagSet("flake order", flag.ExitOnError)
+	runs = fs.Int64("runs", 100, "Try at most this many random orders to find a failure")
+	tries = fs.Int64("tries", 10, "Run each order this many times to decide whether it fails")
+	parallelism = fs.Int("p", runtime.GOMAXPROCS(0), "Run this many processes in parallel")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake order [flags...] go test [flags...] [package]
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+Flake order looks for tests that fail only when they run after certain other
+tests. It builds the package's test binary once and runs it with random
+-shuffle seeds until a test fails. Then it checks that the failure depends on
+the order (it recurs with the same seed but not when the test runs alone)
+and bisects the tests that ran before the failing test to find the ones that
+interfere with it.
+
+Flake order exits with status 3 if it found an order dependence and 0 if
+not.
+`)
+	}
+	return fs, runs, tries, parallelism
+}
+
+func orderMain(args []string) {
+	fs, runs, tries, parallelism := orderFlags()
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *runs < 1 || *tries < 1 || *parallelism < 1 {
+		log.Fatalln("-runs, -tries, and -p must be positive")
+	}
+	gt, err := parseGoTest(&command{args: fs.Args()})
+	if err != nil {
+		log.Fatalln("Cannot use flake order:", err)
+	}
+	o := &orderSearch{run: gt.removeTestFlag("run")}
+	gt.removeTestFlag("shuffle")
+	gt.removeTestFlag("v")
+	dir, err := os.MkdirTemp("", "flake-test-")
+	if err != nil {
+		log.Fatalln("Cannot compile test:", err)
+	}
+	if o.cmd, err = gt.compile(dir); err != nil {
+		os.RemoveAll(dir)
+		log.Fatalln("Cannot compile test:", err)
+	}
+	var leaks leakAudit
+	for i := 1; i <= *parallelism; i++ {
+		o.workers = append(o.workers, &worker{num: i, numaNode: -1, leaks: &leaks})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	status := o.find(ctx, gt, *runs, *tries)
+	if ctx.Err() != nil {
+		log.Println("Interrupted")
+		status = 1
+	}
+	if s := leaks.String(); s != "" {
+		log.Printf("Warning: %s", s)
+	}
+	os.RemoveAll(dir)
+	os.Exit(status)
+}
+
+// find looks for an order dependence among the tests of gt, as described by
+// flake order -h, and returns the exit status.
+func (o *orderSearch) find(ctx context.Context, gt *goTest, runs, tries int64) int {
+	// Find a failing order.
+	log.Printf("Running %s in up to %d random orders", gt.pkg, runs)
+	start := time.Now()
+	var (
+		tried  int64
+		seed   int64
+		order  []string
+		victim string
+	)
+	o.each(ctx, rand.Int64, nil, runs, func(s int64, err error) bool {
+		tried++
+		failed := failedTests(err)
+		if len(failed) == 0 {
+			return true
+		}
+		seed, victim = s, failed[0]
+		for _, m := range runLineRx.FindAllSubmatch(err.(*runError).output, -1) {
+			if test := string(m[1]); !slices.Contains(order, test) {
+				order = append(order, test)
+			}
+		}
+		return false
+	})
+	if ctx.Err() != nil {
+		return 1
+	}
+	if victim == "" {
+		log.Printf("No test failed in %d random order(s) (%s)", tried, time.Since(start).Round(time.Second))
+		return 0
+	}
+	log.Printf("%s failed with -shuffle %d (random order %d)", victim, seed, tried)
+	i := slices.Index(order, victim)
+	if i < 0 {
+		log.Printf("Cannot tell when %s ran from the output", victim)
+		return 1
+	}
+
+	// Check that the failure depends on the order.
+	withSeed := o.failures(ctx, seed, order[:i+1], victim, tries)
+	alone := o.failures(ctx, seed, []string{victim}, victim, tries)
+	if ctx.Err() != nil {
+		return 1
+	}
+	log.Printf("%s failed in %d/%d runs in the same order and in %d/%d runs alone", victim, withSeed, tries, alone, tries)
+	switch {
+	case alone > 0:
+		log.Printf("%s fails without other tests, so the failure does not depend on the order", victim)
+		return 0
+	case withSeed == 0 || i == 0:
+		log.Printf("The failure did not recur in the same order, so it may not depend on the order (or it needs a larger -tries)")
+		return 0
+	}
+
+	// Bisect the tests that ran before the victim.
+	candidates := order[:i]
+	log.Printf("Bisecting the %d test(s) that ran before %s", len(candidates), victim)
+	for len(candidates) > 1 {
+		half := len(candidates) / 2
+		first, second := candidates[:half], candidates[half:]
+		if o.fails(ctx, seed, append(slices.Clone(first), victim), victim, tries) {
+			candidates = first
+		} else if o.fails(ctx, seed, append(slices.Clone(second), victim), victim, tries) {
+			candidates = second
+		} else {
+			break // it takes tests from both halves (or a larger -tries)
+		}
+		log.Printf("Narrowed down to %d test(s)", len(candidates))
+	}
+	if ctx.Err() != nil {
+		return 1
+	}
+	if len(candidates) == 1 {
+		log.Printf("%s fails after %s", victim, candidates[0])
+	} else {
+		log.Printf("%s fails after these %d tests together: %s", victim, len(candidates), strings.Join(candidates, ", "))
+	}
+	repro := slices.Concat([]string{gt.goTool, "test"}, gt.build, []string{
+		"-count=1", "-v", "-shuffle=" + strconv.FormatInt(seed, 10),
+		"-run=" + testsPattern(append(slices.Clone(candidates), victim)), gt.pkg,
+	})
+	log.Printf("Reproduce with: %s", quoteCommand(repro))
+	return exitFailed
+}
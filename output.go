@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A stampedOutput records a run's stdout and stderr separately for
+// -timestamps, starting each line with the time since the run started, and
+// also interleaved in one log that tags each line with its stream.
+type stampedOutput struct {
+	mu       sync.Mutex
+	start    time.Time
+	combined outputBuffer
+	last     *stampedStream // that wrote to combined
+}
+
+// newStampedOutput returns a stampedOutput that keeps at most limit bytes
+// (if positive) of each stream and of the combined log.
+func newStampedOutput(start time.Time, limit int64) *stampedOutput {
+	return &stampedOutput{start: start, combined: outputBuffer{limit: limit}}
+}
+
+// stream returns a writer for the stream with the given name, which also
+// writes to w.
+func (s *stampedOutput) stream(name string, w io.Writer) *stampedStream {
+	return &stampedStream{out: s, name: name, w: w, buf: outputBuffer{limit: s.combined.limit}}
+}
+
+// A stampedStream is one stream of a stampedOutput.
+type stampedStream struct {
+	out     *stampedOutput
+	name    string
+	w       io.Writer // also gets the stream, unstamped
+	buf     outputBuffer
+	midLine bool
+}
+
+func (ss *stampedStream) Write(p []byte) (int, error) {
+	s := ss.out
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp := fmt.Sprintf("+%.6fs", time.Since(s.start).Seconds())
+	for rest := p; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if s.last != nil && s.last != ss && s.last.midLine {
+			// Split the other stream's partial line.
+			s.combined.Write([]byte{'\n'})
+		}
+		if !ss.midLine || s.last != ss {
+			fmt.Fprintf(&s.combined, "%s %s| ", stamp, ss.name)
+		}
+		if !ss.midLine {
+			fmt.Fprintf(&ss.buf, "%s ", stamp)
+		}
+		ss.buf.Write(line)
+		s.combined.Write(line)
+		ss.midLine = line[len(line)-1] != '\n'
+		s.last = ss
+	}
+	// Write under the lock, since the streams share w.
+	return ss.w.Write(p)
+}
+
+// bytes returns the recorded stream.
+func (ss *stampedStream) bytes() []byte {
+	ss.out.mu.Lock()
+	defer ss.out.mu.Unlock()
+	return bytes.Clone(ss.buf.Bytes())
+}
+
+// interleaved returns both streams, interleaved.
+func (s *stampedOutput) interleaved() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.combined.Bytes())
+}
+
+// An outputBuffer holds a run's output. If limit is positive and the output
+// grows beyond it, the buffer keeps only the first and last limit/2 bytes,
+// which usually hold the setup and the failure, and notes how much it left
+// out in between.
+type outputBuffer struct {
+	limit   int64
+	head    []byte
+	tail    []byte // up to twice the tail size, to trim in batches
+	dropped int64
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit <= 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+	if room := int(b.limit/2) - len(b.head); room > 0 {
+		k := min(room, len(p))
+		b.head = append(b.head, p[:k]...)
+		p = p[k:]
+	}
+	b.tail = append(b.tail, p...)
+	if size := b.tailSize(); len(b.tail) > 2*size {
+		drop := len(b.tail) - size
+		b.dropped += int64(drop)
+		b.tail = append(b.tail[:0], b.tail[drop:]...)
+	}
+	return n, nil
+}
+
+func (b *outputBuffer) tailSize() int {
+	return int(b.limit - b.limit/2)
+}
+
+// Bytes returns the output, with a marker where any was left out. It may
+// alias the buffer until the next Write or Reset.
+func (b *outputBuffer) Bytes() []byte {
+	tail, dropped := b.tail, b.dropped
+	if size := b.tailSize(); b.limit > 0 && len(tail) > size {
+		dropped += int64(len(tail) - size)
+		tail = tail[len(tail)-size:]
+	}
+	if len(tail) == 0 {
+		return b.head
+	}
+	out := slices.Clip(b.head)
+	if dropped > 0 {
+		out = fmt.Appendf(out, "\n... [%d bytes of output omitted by -max-output] ...\n", dropped)
+	}
+	return append(out, tail...)
+}
+
+func (b *outputBuffer) Reset() {
+	b.head = b.head[:0]
+	b.tail = b.tail[:0]
+	b.dropped = 0
+}
+
+// A follower copies the output of one worker's runs to stdout as it is
+// produced, for -follow. Each line starts with the run's ID.
+type follower struct {
+	mu    sync.Mutex
+	clear bool // clear the progress line before writing
+}
+
+// run returns a writer for the output of run id. The caller must flush it
+// when the run finishes.
+func (f *follower) run(id int64) *followRun {
+	return &followRun{f: f, prefix: fmt.Sprintf("run %d| ", id)}
+}
+
+type followRun struct {
+	f       *follower
+	prefix  string
+	partial []byte // an unfinished line
+}
+
+func (fr *followRun) Write(p []byte) (int, error) {
+	fr.partial = append(fr.partial, p...)
+	i := bytes.LastIndexByte(fr.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	fr.print(fr.partial[:i+1])
+	fr.partial = append(fr.partial[:0], fr.partial[i+1:]...)
+	return len(p), nil
+}
+
+// flush prints any unfinished last line.
+func (fr *followRun) flush() {
+	if len(fr.partial) > 0 {
+		fr.print(append(fr.partial, '\n'))
+		fr.partial = fr.partial[:0]
+	}
+}
+
+func (fr *followRun) print(lines []byte) {
+	var b bytes.Buffer
+	if fr.f.clear {
+		b.WriteString("\r\x1b[K")
+	}
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			b.WriteString(fr.prefix)
+			b.Write(line)
+		}
+	}
+	fr.f.mu.Lock()
+	defer fr.f.mu.Unlock()
+	os.Stdout.Write(b.Bytes())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// A pauseGate holds workers back from starting new runs while it is closed.
+// Runs that are already in flight are unaffected.
+type pauseGate struct {
+	mu     sync.Mutex
+	open   chan struct{} // closed while the gate is open
+	closed bool
+}
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{open: make(chan struct{})}
+	close(g.open)
+	return g
+}
+
+// wait blocks until the gate is open or ctx is done.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	open := g.open
+	g.mu.Unlock()
+	select {
+	case <-open:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *pauseGate) setClosed(closed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if closed == g.closed {
+		return
+	}
+	g.closed = closed
+	if closed {
+		g.open = make(chan struct{})
+	} else {
+		close(g.open)
+	}
+}
+
+func (g *pauseGate) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
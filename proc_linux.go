@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// procSupported reports whether groupProcs and cpuLimitExec are implemented.
+const procSupported = true
+
+// groupProcs returns the processes that are still members of process group
+// pgid by scanning /proc.
+func groupProcs(pgid int) []procInfo {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var procs []procInfo
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name is in parentheses and may itself contain
+		// spaces or parentheses, so parse from the last ')'.
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		// Fields after the command name: state ppid pgrp session tty_nr
+		// tpgid flags minflt cminflt majflt cmajflt utime stime cutime
+		// cstime priority nice num_threads itrealvalue starttime vsize
+		// rss ...
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) < 15 {
+			continue
+		}
+		if pg, err := strconv.Atoi(fields[2]); err != nil || pg != pgid {
+			continue
+		}
+		p := procInfo{
+			pid:    pid,
+			zombie: fields[0] == "Z",
+		}
+		for _, f := range fields[11:15] {
+			n, _ := strconv.ParseUint(f, 10, 64)
+			p.cpuTicks += n
+		}
+		if len(fields) > 21 {
+			pages, _ := strconv.ParseInt(fields[21], 10, 64)
+			p.rss = pages * int64(os.Getpagesize())
+		}
+		cmdline, _ := os.ReadFile("/proc/" + e.Name() + "/cmdline")
+		cmdline = bytes.TrimRight(cmdline, "\x00")
+		p.cmdline = string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '}))
+		if p.cmdline == "" {
+			p.cmdline = "[" + string(stat[bytes.IndexByte(stat, '(')+1:i]) + "]"
+		}
+		procs = append(procs, p)
+	}
+	return procs
+}
+
+// openFiles describes the open file descriptors of the processes in process
+// group pgid and the sockets among them (as ss(8) shows them, if it is
+// installed), for diagnosing a hung run.
+func openFiles(pgid int) []byte {
+	var b bytes.Buffer
+	inodes := make(map[string]bool) // of sockets
+	for _, p := range groupProcs(pgid) {
+		fmt.Fprintf(&b, "process %d: %s\n", p.pid, p.cmdline)
+		dir := fmt.Sprintf("/proc/%d/fd", p.pid)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintf(&b, "  (%s)\n", err)
+			continue
+		}
+		fds := make([]int, 0, len(entries))
+		for _, e := range entries {
+			if fd, err := strconv.Atoi(e.Name()); err == nil {
+				fds = append(fds, fd)
+			}
+		}
+		slices.Sort(fds)
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(dir, strconv.Itoa(fd)))
+			if err != nil {
+				continue // closed meanwhile
+			}
+			fmt.Fprintf(&b, "  %d -> %s\n", fd, target)
+			if inode, ok := strings.CutPrefix(target, "socket:["); ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return b.Bytes()
+	}
+	out, err := exec.Command("ss", "-anpe").Output()
+	if err != nil {
+		fmt.Fprintf(&b, "(cannot list sockets with ss: %s)\n", err)
+		return b.Bytes()
+	}
+	b.WriteString("sockets:\n")
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, field := range strings.Fields(line) {
+			if inode, ok := strings.CutPrefix(field, "ino:"); ok && inodes[inode] {
+				fmt.Fprintf(&b, "  %s\n", strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// cpuTimes returns the busy and total CPU time (in clock ticks) across all
+// CPUs since boot.
+func cpuTimes() (busy, total uint64, err error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat line %q", line)
+	}
+	// user nice system idle iowait irq softirq steal ...
+	for i, f := range fields[1:] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad /proc/stat field %q", f)
+		}
+		total += n
+		if i != 3 && i != 4 { // idle, iowait
+			busy += n
+		}
+	}
+	return busy, total, nil
+}
+
+// memAvailable returns the amount of memory available for starting new
+// processes without swapping.
+func memAvailable() (int64, error) {
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		rest, ok := strings.CutPrefix(line, "MemAvailable:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(rest, "kB")), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad /proc/meminfo line %q", line)
+		}
+		return kb << 10, nil
+	}
+	return 0, errors.New("no MemAvailable in /proc/meminfo")
+}
+
+// loadAverage returns the 1-minute load average.
+func loadAverage() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	field, _, _ := strings.Cut(string(b), " ")
+	return strconv.ParseFloat(field, 64)
+}
+
+// lastTerminalInput returns the time of the most recent input on any
+// terminal, which the kernel records as the terminal's access time, or the
+// zero time if there are no terminals.
+func lastTerminalInput() (time.Time, error) {
+	var names []string
+	for _, pattern := range []string{"/dev/pts/[0-9]*", "/dev/tty[0-9]*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return time.Time{}, err
+		}
+		names = append(names, matches...)
+	}
+	var last time.Time
+	for _, name := range names {
+		var st unix.Stat_t
+		if err := unix.Stat(name, &st); err != nil {
+			continue // the terminal went away
+		}
+		if t := time.Unix(st.Atim.Unix()); t.After(last) {
+			last = t
+		}
+	}
+	return last, nil
+}
+
+// cpuLimitExec limits the CPU time of flake (and so of args and any
+// processes it starts) to limit (as set in cpuLimitEnv) and then executes
+// args in place of flake, through seccompExec if seccompEnv is also set. A
+// process receives SIGXCPU when it reaches the limit and SIGKILL one second
+// later. It only returns by exiting.
+func cpuLimitExec(limit string, args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "flake: cannot run %s with -cpu-limit %s: %s\n", args[0], limit, err)
+		os.Exit(1)
+	}
+	d, err := time.ParseDuration(limit)
+	if err != nil {
+		fail(err)
+	}
+	secs := uint64((d + time.Second - 1) / time.Second)
+	rlim := unix.Rlimit{Cur: secs, Max: secs + 1}
+	if err := unix.Setrlimit(unix.RLIMIT_CPU, &rlim); err != nil {
+		fail(err)
+	}
+	os.Unsetenv(cpuLimitEnv)
+	if spec := os.Getenv(seccompEnv); spec != "" {
+		seccompExec(spec, args)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err)
+	}
+	fail(unix.Exec(path, args, os.Environ()))
+}
+
+// numaNodes returns the NUMA nodes that have CPUs.
+func numaNodes() ([]int, error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var nodes []int
+	for _, dir := range dirs {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		cpus, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil || len(bytes.TrimSpace(cpus)) == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no NUMA nodes with CPUs found")
+	}
+	slices.Sort(nodes)
+	return nodes, nil
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const procSupported = false
+
+// groupProcs is only implemented on Linux.
+func groupProcs(pgid int) []procInfo { return nil }
+
+func openFiles(pgid int) []byte { return nil }
+
+func cpuTimes() (busy, total uint64, err error) {
+	return 0, 0, errors.New("CPU usage is not available on this platform")
+}
+
+func memAvailable() (int64, error) {
+	return 0, errors.New("available memory is not known on this platform")
+}
+
+func loadAverage() (float64, error) {
+	return 0, errors.New("the load average is not known on this platform")
+}
+
+func lastTerminalInput() (time.Time, error) {
+	return time.Time{}, errors.New("terminal input is not tracked on this platform")
+}
+
+// cpuLimitExec is only implemented on Linux.
+func cpuLimitExec(limit string, args []string) {
+	log.Fatalln("-cpu-limit is only supported on Linux")
+}
+
+func numaNodes() ([]int, error) {
+	return nil, errors.New("NUMA nodes are not known on this platform")
+}
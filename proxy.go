@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyFaults are the probabilities with which a -proxy proxy injects each
+// kind of fault into a request.
+type proxyFaults struct {
+	spec  string
+	reset float64 // close the client's connection abruptly
+	error float64 // respond 503 Service Unavailable
+	delay float64 // wait a while (-proxy-delay) before handling the request
+}
+
+// parseProxyFaults parses a -proxy list such as "reset=1%,5xx=0.02,delay=5%".
+func parseProxyFaults(s string) (*proxyFaults, error) {
+	pf := &proxyFaults{spec: s}
+	for _, field := range strings.Split(s, ",") {
+		name, p, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form fault=probability", field)
+		}
+		var prob float64
+		var err error
+		if strings.HasSuffix(p, "%") {
+			prob, err = parsePercent(p)
+		} else if prob, err = strconv.ParseFloat(p, 64); err == nil && (prob <= 0 || prob > 1) {
+			err = fmt.Errorf("%s is not a probability in (0, 1]", p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "reset":
+			pf.reset = prob
+		case "5xx":
+			pf.error = prob
+		case "delay":
+			pf.delay = prob
+		default:
+			return nil, fmt.Errorf("unknown fault %q (want reset, 5xx, or delay)", name)
+		}
+	}
+	if pf.reset+pf.error > 1 {
+		return nil, errors.New("the reset and 5xx probabilities add up to more than 1")
+	}
+	return pf, nil
+}
+
+// A faultProxy is an HTTP proxy for one run, which injects faults into some
+// of the requests (including CONNECT requests for HTTPS) that pass through
+// it. The proxy resolves host names, so a delay before connecting stands in
+// for a slow DNS lookup or connection.
+type faultProxy struct {
+	faults *proxyFaults
+	delay  time.Duration
+	rng    *rand.Rand // guarded by mu
+	ln     net.Listener
+	srv    *http.Server
+	resets atomic.Int64
+	errors atomic.Int64
+	delays atomic.Int64
+
+	mu      sync.Mutex
+	tunnels map[net.Conn]bool // hijacked connections, which srv does not track
+}
+
+// startFaultProxy starts a proxy on a local port that chooses faults with
+// rng.
+func startFaultProxy(faults *proxyFaults, delay time.Duration, rng *rand.Rand) (*faultProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &faultProxy{faults: faults, delay: delay, rng: rng, ln: ln, tunnels: make(map[net.Conn]bool)}
+	p.srv = &http.Server{Handler: p}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+// env returns the environment variables that point HTTP clients at p.
+func (p *faultProxy) env() []string {
+	u := "http://" + p.ln.Addr().String()
+	return []string{"HTTP_PROXY=" + u, "HTTPS_PROXY=" + u, "http_proxy=" + u, "https_proxy=" + u}
+}
+
+// close shuts p down, including any open tunnels.
+func (p *faultProxy) close() {
+	p.srv.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.tunnels {
+		conn.Close()
+	}
+}
+
+// String summarizes the faults that p injected.
+func (p *faultProxy) String() string {
+	return fmt.Sprintf("%d reset(s), %d 503 response(s), %d delay(s) of %s",
+		p.resets.Load(), p.errors.Load(), p.delays.Load(), p.delay)
+}
+
+// choose returns two random numbers for a request: one to decide whether to
+// delay it and one to choose a fault.
+func (p *faultProxy) choose() (delay, fault float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rng.Float64(), p.rng.Float64()
+}
+
+func (p *faultProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delay, fault := p.choose()
+	if delay < p.faults.delay {
+		p.delays.Add(1)
+		select {
+		case <-time.After(p.delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	switch {
+	case fault < p.faults.reset:
+		p.resets.Add(1)
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetLinger(0) // send a RST
+			}
+			conn.Close()
+		}
+		return
+	case fault < p.faults.reset+p.faults.error:
+		p.errors.Add(1)
+		http.Error(w, "flake -proxy: injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if r.URL.Host == "" {
+		http.Error(w, "flake -proxy: not a proxy request", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := proxyTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+var proxyTransport = &http.Transport{Proxy: nil, DisableCompression: true}
+
+// tunnel handles a CONNECT request by relaying bytes between the client and
+// the requested host.
+func (p *faultProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	upstream, err := d.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	p.mu.Lock()
+	p.tunnels[client] = true
+	p.tunnels[upstream] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.tunnels, client)
+		delete(p.tunnels, upstream)
+		p.mu.Unlock()
+	}()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const ptySupported = true
+
+// ptyDrain is how long flake keeps reading a run's terminal after the
+// command exits, in case processes that it left running still hold it.
+const ptyDrain = time.Second
+
+// A pty is a pseudo-terminal for one -pty run.
+type pty struct {
+	ptmx *os.File // the controlling side, which flake reads
+	tty  *os.File // the terminal side, for the command
+	done chan struct{}
+}
+
+func openPTY() (*pty, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(ptmx.Fd())
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err == nil {
+		err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	}
+	if err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	tty, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 24, Col: 80})
+	return &pty{ptmx: ptmx, tty: tty}, nil
+}
+
+// attach makes the terminal cmd's standard input, output, and error and its
+// controlling terminal. The command gets its own session, and so still its
+// own process group.
+func (p *pty) attach(cmd *exec.Cmd) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = p.tty, p.tty, p.tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
+
+// copyOutput copies what the command writes to the terminal to w. It must be
+// called after the command starts.
+func (p *pty) copyOutput(w io.Writer) {
+	p.tty.Close()
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		io.Copy(w, p.ptmx) // ends with EIO once the terminal is closed
+	}()
+}
+
+// close waits (for at most ptyDrain) for copyOutput to finish, and releases
+// the terminal.
+func (p *pty) close() {
+	p.tty.Close()
+	if p.done != nil {
+		select {
+		case <-p.done:
+		case <-time.After(ptyDrain):
+		}
+	}
+	p.ptmx.Close()
+	if p.done != nil {
+		<-p.done
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+const ptySupported = false
+
+// pty is only implemented on Linux.
+type pty struct{}
+
+func openPTY() (*pty, error) {
+	return nil, errors.New("pseudo-terminals are not supported on this platform")
+}
+
+func (p *pty) attach(cmd *exec.Cmd)   {}
+func (p *pty) copyOutput(w io.Writer) {}
+func (p *pty) close()                 {}
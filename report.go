@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxReportExamples is how many failures (each with a different signature)
+// flake report shows the output of.
+const maxReportExamples = 10
+
+// A sessionReport is what flake report shows of a recorded session, ready
+// for its templates.
+type sessionReport struct {
+	Name       string
+	Started    string // the time of the first event
+	Elapsed    string
+	Finished   bool
+	Code       string
+	Seed       uint64
+	Runs       int64 // passed and failed
+	Passed     int64
+	Failures   int64
+	Rate       string   // the failure rate with a confidence interval, if there were runs
+	Other      string   // the runs that are not counted, if any
+	Durations  string   // of the passing runs, if any
+	Analysis   string   // of the failing runs' durations, if there are enough
+	Signatures []string // the failure summary
+	Examples   []reportExample
+}
+
+// A reportExample is a failure shown in full, the first with its signature.
+type reportExample struct {
+	Run     int64
+	Worker  int
+	Elapsed string
+	Error   string
+	Output  string
+}
+
+func newSessionReport(s *mergedSession, signatures *failureSignatures) *sessionReport {
+	r := &sessionReport{
+		Name:     s.name,
+		Started:  s.first.Format(time.RFC3339),
+		Elapsed:  s.last.Sub(s.first).Round(time.Second).String(),
+		Finished: s.ended,
+		Code:     s.code,
+		Seed:     s.seed,
+		Runs:     s.passed + s.failures,
+		Passed:   s.passed,
+		Failures: s.failures,
+	}
+	if r.Runs > 0 {
+		lower, upper := wilsonInterval(s.failures, r.Runs, 1.96)
+		r.Rate = fmt.Sprintf("%.3g%% (95%% confidence interval %.3g%% to %.3g%%)",
+			100*float64(s.failures)/float64(r.Runs), 100*lower, 100*upper)
+	}
+	var other []string
+	for _, o := range []struct {
+		n    int64
+		desc string
+	}{
+		{s.errors, "error(s) running the command"},
+		{s.unconfirmed, "unconfirmed failure(s)"},
+		{s.ignored, "ignored failure(s)"},
+		{s.cancelled, "run(s) cancelled at the end of the session"},
+		{s.started - s.finished(), "run(s) with no finish event"},
+	} {
+		if o.n > 0 {
+			other = append(other, fmt.Sprintf("%d %s", o.n, o.desc))
+		}
+	}
+	r.Other = strings.Join(other, ", ")
+	if len(s.passing.sample) > 0 {
+		r.Durations = fmt.Sprintf("Passing runs took %s (median of %d).", median(s.passing.sample), s.passing.n)
+	}
+	r.Analysis = analyzeDurations(&s.passing, s.failing)
+	if s.failures > 0 {
+		r.Signatures = signatures.summary()
+	}
+	for _, g := range signatures.sorted() {
+		ev := s.examples[g.sig]
+		if ev == nil || len(r.Examples) == maxReportExamples {
+			continue
+		}
+		r.Examples = append(r.Examples, reportExample{
+			Run:     ev.Run,
+			Worker:  ev.Worker,
+			Elapsed: time.Duration(ev.Elapsed * float64(time.Second)).Round(time.Millisecond).String(),
+			Error:   ev.Error,
+			Output:  strings.TrimSuffix(ev.Output, "\n"),
+		})
+	}
+	return r
+}
+
+// finished returns the number of runs that have a finish event.
+func (s *mergedSession) finished() int64 {
+	return s.passed + s.failures + s.errors + s.unconfirmed + s.ignored + s.cancelled
+}
+
+var reportText = template.Must(template.New("text").Parse(
+	`Session {{.Name}}: started {{.Started}}, ran for {{.Elapsed}}{{if not .Finished}} (did not finish){{end}}
+{{with .Code}}Code: {{.}}
+{{end}}{{with .Seed}}Session seed: {{.}}
+{{end}}{{.Runs}} run(s): {{.Passed}} passed, {{.Failures}} failed{{with .Rate}}; failure rate {{.}}{{end}}
+{{with .Other}}Not counted: {{.}}
+{{end}}{{with .Durations}}{{.}}
+{{end}}{{with .Analysis}}{{.}}
+{{end}}{{range .Signatures}}{{.}}
+{{end}}{{range .Examples}}
+Run {{.Run}} (worker {{.Worker}}, {{.Elapsed}}): {{.Error}}:
+{{.Output}}
+{{end}}`))
+
+var reportMarkdown = template.Must(template.New("markdown").Funcs(template.FuncMap{"fence": codeFence}).Parse(
+	`# Flake session {{.Name}}
+
+- Started {{.Started}}, ran for {{.Elapsed}}{{if not .Finished}} (did not finish){{end}}
+{{with .Code}}- Code: {{.}}
+{{end}}{{with .Seed}}- Session seed: {{.}}
+{{end}}- {{.Runs}} run(s): {{.Passed}} passed, {{.Failures}} failed{{with .Rate}}; failure rate {{.}}{{end}}
+{{with .Other}}- Not counted: {{.}}
+{{end}}{{with .Durations}}- {{.}}
+{{end}}{{with .Analysis}}- {{.}}
+{{end}}{{if .Signatures}}
+## Failures
+
+{{fence ""}}
+{{range .Signatures}}{{.}}
+{{end}}{{fence ""}}
+{{range .Examples}}
+### Run {{.Run}}: {{.Error}}
+
+Worker {{.Worker}}, {{.Elapsed}}:
+
+{{fence .Output}}
+{{.Output}}
+{{fence .Output}}
+{{end}}{{end}}`))
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Flake session {{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Flake session {{.Name}}</h1>
+<ul>
+<li>Started {{.Started}}, ran for {{.Elapsed}}{{if not .Finished}} (did not finish){{end}}</li>
+{{with .Code}}<li>Code: {{.}}</li>
+{{end}}{{with .Seed}}<li>Session seed: {{.}}</li>
+{{end}}<li>{{.Runs}} run(s): {{.Passed}} passed, {{.Failures}} failed{{with .Rate}}; failure rate {{.}}{{end}}</li>
+{{with .Other}}<li>Not counted: {{.}}</li>
+{{end}}{{with .Durations}}<li>{{.}}</li>
+{{end}}{{with .Analysis}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Signatures}}<h2>Failures</h2>
+<pre>{{range .Signatures}}{{.}}
+{{end}}</pre>
+{{range .Examples}}<h3>Run {{.Run}}: {{.Error}}</h3>
+<p>Worker {{.Worker}}, {{.Elapsed}}:</p>
+<pre>{{.Output}}</pre>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// codeFence returns a Markdown code fence that s cannot end.
+func codeFence(s string) string {
+	fence := "```"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+// reportFlags defines the flags of flake report.
+func reportFlags() (fs *flag.FlagSet, format *string, similarity *float64) {
+	fs = flag.NewFlagSet("flake report", flag.ExitOnError)
+	format = fs.String("format", "text", "Write the report in this format: text, markdown, or html")
+	similarity = fs.Float64("similarity", defaultSimilarity, "Show failure signatures that are at least this similar (from 0\nto 1) together; 0 shows each signature on its own")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake report [flags...] <file>
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+Flake report writes a report of a session from the event stream that flake
+-json recorded: the runs and failures, the failure rate, how the durations of
+failing runs compare, the failures grouped by signature, and the output of the
+first failure with each signature. This makes it possible to try other
+formats, or to report on a session again, without rerunning it.
+`)
+	}
+	return fs, format, similarity
+}
+
+func reportMain(args []string) {
+	fs, format, similarity := reportFlags()
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var write func(io.Writer, any) error
+	switch *format {
+	case "text":
+		write = reportText.Execute
+	case "markdown":
+		write = reportMarkdown.Execute
+	case "html":
+		write = reportHTML.Execute
+	default:
+		log.Fatalln("-format must be text, markdown, or html")
+	}
+	if *similarity < 0 || *similarity > 1 {
+		log.Fatalln("-similarity must be between 0 and 1")
+	}
+	signatures := failureSignatures{similarity: *similarity}
+	s, err := readSession(fs.Arg(0), &signatures)
+	if err != nil {
+		log.Fatalln("Cannot read events:", err)
+	}
+	if s.started == 0 && !s.ended {
+		log.Fatalf("No events in %s", fs.Arg(0))
+	}
+	if err := write(os.Stdout, newSessionReport(s, &signatures)); err != nil {
+		log.Fatalln("Cannot write report:", err)
+	}
+}
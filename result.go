@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A childResult is structured context about a failure that a run may write,
+// as JSON, to the file named by $FLAKE_RESULT_FILE.
+type childResult struct {
+	Case    string             `json:"case,omitempty"` // such as the failing test
+	Seed    any                `json:"seed,omitempty"` // number or string
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+// resultFile returns the name to use for $FLAKE_RESULT_FILE for run id,
+// which uses tmpdir if it is nonempty.
+func resultFile(id int64, tmpdir string) string {
+	if tmpdir != "" {
+		return filepath.Join(tmpdir, "flake-result.json")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("flake-result-%d-%d.json", os.Getpid(), id))
+}
+
+// readResultFile reads and removes a run's result file. It returns nil if
+// the run did not write one.
+func readResultFile(name string) (*childResult, error) {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	os.Remove(name)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var res childResult
+	if err := dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("bad $FLAKE_RESULT_FILE: %s", err)
+	}
+	return &res, nil
+}
+
+func (res *childResult) String() string {
+	var parts []string
+	if res.Case != "" {
+		parts = append(parts, "case "+res.Case)
+	}
+	if res.Seed != nil {
+		parts = append(parts, fmt.Sprintf("seed %v", res.Seed))
+	}
+	names := make([]string, 0, len(res.Metrics))
+	for name := range res.Metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%g", name, res.Metrics[name]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// seccompEnv is set, to the list of rules to apply, in the environment of a
+// flake process that installs a seccomp filter and then executes a run's
+// command (see seccompExec).
+const seccompEnv = "FLAKE_SECCOMP_EXEC"
+
+// A seccompRule makes a system call fail with an error number in some or
+// all runs.
+type seccompRule struct {
+	syscall  string
+	errno    string
+	fraction float64 // of runs that the rule applies to
+}
+
+func (r seccompRule) String() string {
+	return r.syscall + "=" + r.errno
+}
+
+// parseSeccompRules parses a -seccomp list such as
+// "fsync=EIO,connect=ECONNREFUSED@0.1".
+func parseSeccompRules(s string) ([]seccompRule, error) {
+	var rules []seccompRule
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		rule, fraction, hasFraction := strings.Cut(field, "@")
+		name, errno, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not of the form syscall=ERRNO[@fraction]", field)
+		}
+		r := seccompRule{syscall: strings.ToLower(name), errno: strings.ToUpper(errno), fraction: 1}
+		if _, ok := seccompSyscalls[r.syscall]; !ok {
+			return nil, fmt.Errorf("unknown (or unsupported) system call %q", name)
+		}
+		if errnoValue(r.errno) == 0 {
+			return nil, fmt.Errorf("unknown error number %q", errno)
+		}
+		if hasFraction {
+			f, err := strconv.ParseFloat(fraction, 64)
+			if err != nil || f <= 0 || f > 1 {
+				return nil, fmt.Errorf("fraction %q is not in (0, 1]", fraction)
+			}
+			r.fraction = f
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompArch is the audit architecture of the system calls that a -seccomp
+// filter matches, or zero if filters are not implemented for this GOARCH.
+var seccompArch = map[string]uint32{
+	"386":     unix.AUDIT_ARCH_I386,
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"ppc64":   unix.AUDIT_ARCH_PPC64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}[runtime.GOARCH]
+
+var seccompSupported = seccompArch != 0
+
+// seccompSyscalls maps the names of the system calls that -seccomp can make
+// fail to their numbers. It only lists calls that programs are expected to
+// handle failures of (mostly I/O), on every architecture.
+var seccompSyscalls = map[string]uintptr{
+	"accept4":    unix.SYS_ACCEPT4,
+	"bind":       unix.SYS_BIND,
+	"connect":    unix.SYS_CONNECT,
+	"fallocate":  unix.SYS_FALLOCATE,
+	"fdatasync":  unix.SYS_FDATASYNC,
+	"flock":      unix.SYS_FLOCK,
+	"fsync":      unix.SYS_FSYNC,
+	"ftruncate":  unix.SYS_FTRUNCATE,
+	"getrandom":  unix.SYS_GETRANDOM,
+	"listen":     unix.SYS_LISTEN,
+	"mkdirat":    unix.SYS_MKDIRAT,
+	"openat":     unix.SYS_OPENAT,
+	"pread64":    unix.SYS_PREAD64,
+	"pwrite64":   unix.SYS_PWRITE64,
+	"read":       unix.SYS_READ,
+	"recvfrom":   unix.SYS_RECVFROM,
+	"recvmsg":    unix.SYS_RECVMSG,
+	"renameat2":  unix.SYS_RENAMEAT2,
+	"sendmsg":    unix.SYS_SENDMSG,
+	"sendto":     unix.SYS_SENDTO,
+	"setsockopt": unix.SYS_SETSOCKOPT,
+	"socket":     unix.SYS_SOCKET,
+	"sync":       unix.SYS_SYNC,
+	"syncfs":     unix.SYS_SYNCFS,
+	"unlinkat":   unix.SYS_UNLINKAT,
+	"write":      unix.SYS_WRITE,
+}
+
+// errnoValue returns the error number with the given name (such as "EIO"),
+// or zero if there is none.
+func errnoValue(name string) syscall.Errno {
+	for e := syscall.Errno(1); e < 4096; e++ {
+		if unix.ErrnoName(e) == name {
+			return e
+		}
+	}
+	return 0
+}
+
+// seccompExec installs a seccomp filter that applies the rules in spec (as
+// set in seccompEnv) and then executes args in place of flake. It only
+// returns by exiting.
+func seccompExec(spec string, args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "flake: cannot run %s with -seccomp %s: %s\n", args[0], spec, err)
+		os.Exit(1)
+	}
+	rules, err := parseSeccompRules(spec)
+	if err != nil {
+		fail(err)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err)
+	}
+	env := withoutEnv(os.Environ(), seccompEnv)
+
+	// Load the architecture; if it matches, load the system call number
+	// and compare it to each rule's; otherwise allow the call.
+	n := len(rules)
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: seccompArch, Jf: uint8(2*n + 1)},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	for _, r := range rules {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(seccompSyscalls[r.syscall]), Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(errnoValue(r.errno))},
+		)
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW})
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// The filter applies to the thread that installs it, which must be the
+	// one that calls execve.
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		fail(err)
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		fail(err)
+	}
+	fail(unix.Exec(path, args, env))
+}
+
+// withoutEnv returns env without the variable name.
+func withoutEnv(env []string, name string) []string {
+	var out []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, name+"=") {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
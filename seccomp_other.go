@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"syscall"
+)
+
+const seccompSupported = false
+
+var seccompSyscalls map[string]uintptr
+
+func errnoValue(name string) syscall.Errno { return 0 }
+
+// seccompExec is only implemented on Linux.
+func seccompExec(spec string, args []string) {
+	log.Fatalln("-seccomp is only supported on Linux")
+}
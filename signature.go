@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// maxSignatureRuns is how many run IDs the summary lists for each signature.
+const maxSignatureRuns = 5
+
+var (
+	raceFrameRx = regexp.MustCompile(`(?m)^WARNING: DATA RACE\n(?:Read|Write) at .*\n\s+(\S+?)\(`)
+	fatalRx     = regexp.MustCompile(`(?m)^(?:fatal error|panic): .*$`)
+	testFailRx  = regexp.MustCompile(`(?m)^\s*--- FAIL: \S+`)
+	hexRx       = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	numberRx    = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)?`)
+)
+
+// failureSignature classifies a failure by how it failed: its description
+// (the exit status or signal, and for a run that reported a result, its
+// case), followed by a fingerprint of the output (the first data race,
+// fatal error, panic, or failed test) with numbers and addresses normalized so
+// that failures with the same cause get the same signature.
+func failureSignature(err error) string {
+	re, ok := err.(*runError)
+	if !ok {
+		return err.Error()
+	}
+	desc := re.Error()
+	if re.result != nil && re.result.Case != "" {
+		desc += " in " + re.result.Case
+	}
+	return outputSignature(desc, re.output)
+}
+
+// outputSignature returns the signature of a failure with the given
+// description and output.
+func outputSignature(desc string, output []byte) string {
+	sig := desc
+	var fp string
+	if m := raceFrameRx.FindSubmatch(output); m != nil {
+		fp = "data race in " + string(m[1])
+	} else if m := fatalRx.Find(output); m != nil {
+		fp = string(m)
+	} else if m := testFailRx.Find(output); m != nil {
+		fp = string(bytes.TrimSpace(m))
+	}
+	if fp == "" {
+		return sig
+	}
+	fp = hexRx.ReplaceAllString(fp, "0x?")
+	fp = numberRx.ReplaceAllString(fp, "N")
+	if len(fp) > 100 {
+		fp = fp[:100] + "..."
+	}
+	return sig + ": " + fp
+}
+
+// failureSignatures counts the failures of a session by signature.
+type failureSignatures struct {
+	// similarity is how similar (see signatureSimilarity) two signatures
+	// must be for report to show them together, or 0 to show each
+	// signature on its own.
+	similarity float64
+
+	groups []*signatureGroup // in order of first appearance
+	bySig  map[string]*signatureGroup
+}
+
+// defaultSimilarity is the default -similarity.
+const defaultSimilarity = 0.7
+
+type signatureGroup struct {
+	sig   string
+	count int
+	runs  []string // the first few
+}
+
+// add records a failure of the given run with the given signature.
+func (fs *failureSignatures) add(sig, run string) {
+	g, ok := fs.bySig[sig]
+	if !ok {
+		if fs.bySig == nil {
+			fs.bySig = make(map[string]*signatureGroup)
+		}
+		g = &signatureGroup{sig: sig}
+		fs.bySig[sig] = g
+		fs.groups = append(fs.groups, g)
+	}
+	g.count++
+	if len(g.runs) < maxSignatureRuns {
+		g.runs = append(g.runs, run)
+	}
+}
+
+// report prints the number of failures with each signature, most common
+// first. Signatures that are nearly the same (such as the same panic with
+// different temporary paths) are shown together, under the most common one.
+func (fs *failureSignatures) report() {
+	for _, line := range fs.summary() {
+		log.Print(line)
+	}
+}
+
+// summary returns the lines that report prints.
+func (fs *failureSignatures) summary() []string {
+	var lines []string
+	addf := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	groups := fs.sorted()
+	var total int
+	for _, g := range groups {
+		total += g.count
+	}
+	clusters := clusterSignatures(groups, fs.similarity)
+	if len(clusters) < len(groups) {
+		addf("Failure summary (%d failure(s), %d signature(s) in %d cluster(s)):", total, len(groups), len(clusters))
+	} else {
+		addf("Failure summary (%d failure(s), %d signature(s)):", total, len(groups))
+	}
+	for _, c := range clusters {
+		if len(c) == 1 {
+			addf("  %d failure(s): %s (runs %s)", c[0].count, c[0].sig, c[0].runList())
+			continue
+		}
+		var count int
+		var runs []string
+		for _, g := range c {
+			count += g.count
+			runs = append(runs, g.runs...)
+		}
+		sample := strings.Join(runs[:min(len(runs), maxSignatureRuns)], ", ")
+		if count > maxSignatureRuns {
+			sample += ", ..."
+		}
+		addf("  %d failure(s) with %d similar signatures (runs %s), such as:", count, len(c), sample)
+		for _, g := range c {
+			addf("      %d failure(s): %s (runs %s)", g.count, g.sig, g.runList())
+		}
+	}
+	return lines
+}
+
+// sorted returns the signature groups, most common first.
+func (fs *failureSignatures) sorted() []*signatureGroup {
+	groups := slices.Clone(fs.groups)
+	slices.SortStableFunc(groups, func(a, b *signatureGroup) int { return b.count - a.count })
+	return groups
+}
+
+func (g *signatureGroup) runList() string {
+	runs := strings.Join(g.runs, ", ")
+	if g.count > len(g.runs) {
+		runs += ", ..."
+	}
+	return runs
+}
+
+// clusterSignatures divides groups, most common first, into clusters of
+// signatures that are at least similarity alike. Each group joins the
+// cluster of the first (and so most common) signature that it is like.
+func clusterSignatures(groups []*signatureGroup, similarity float64) [][]*signatureGroup {
+	var clusters [][]*signatureGroup
+	var shingles []map[string]bool // of the first signature of each cluster
+next:
+	for _, g := range groups {
+		s := signatureShingles(g.sig)
+		if similarity > 0 {
+			for i, cs := range shingles {
+				if signatureSimilarity(s, cs) >= similarity {
+					clusters[i] = append(clusters[i], g)
+					continue next
+				}
+			}
+		}
+		clusters = append(clusters, []*signatureGroup{g})
+		shingles = append(shingles, s)
+	}
+	return clusters
+}
+
+var signatureWordRx = regexp.MustCompile(`[\pL\pN_]+`)
+
+// signatureShingles returns the set of pairs of adjacent words in sig. Paths
+// are reduced to their last element and words containing digits are
+// normalized, since temporary directories and IDs differ from run to run.
+func signatureShingles(sig string) map[string]bool {
+	var words []string
+	for _, field := range strings.Fields(strings.ToLower(sig)) {
+		if i := strings.LastIndexAny(strings.TrimRight(field, "/:,"), `/\`); i >= 0 {
+			field = field[i+1:]
+		}
+		words = append(words, signatureWordRx.FindAllString(field, -1)...)
+	}
+	for i, w := range words {
+		if strings.ContainsAny(w, "0123456789") {
+			words[i] = "N"
+		}
+	}
+	shingles := make(map[string]bool)
+	if len(words) == 1 {
+		shingles[words[0]] = true
+	}
+	for i := 1; i < len(words); i++ {
+		shingles[words[i-1]+" "+words[i]] = true
+	}
+	return shingles
+}
+
+// signatureSimilarity returns the Jaccard similarity of two sets of
+// shingles: 1 if they are the same and 0 if they have none in common.
+func signatureSimilarity(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	var common int
+	for s := range a {
+		if b[s] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// exitStatuses counts the failures of a session by how they ended (see
+// runError.exitStatus), since a mix of exit statuses, signals, and timeouts
+// is a different situation from the same failure many times.
+type exitStatuses struct {
+	order  []string // in order of first appearance
+	counts map[string]int64
+}
+
+func (es *exitStatuses) add(err error) {
+	status := "error running the command"
+	if re, ok := err.(*runError); ok {
+		status = re.exitStatus()
+	}
+	if es.counts == nil {
+		es.counts = make(map[string]int64)
+	}
+	if es.counts[status] == 0 {
+		es.order = append(es.order, status)
+	}
+	es.counts[status]++
+}
+
+// report prints a table of the exit statuses, most common first, with the
+// passed runs for comparison.
+func (es *exitStatuses) report(passed int64) {
+	total := passed
+	for _, n := range es.counts {
+		total += n
+	}
+	statuses := slices.Clone(es.order)
+	slices.SortStableFunc(statuses, func(a, b string) int { return cmp.Compare(es.counts[b], es.counts[a]) })
+	var b bytes.Buffer
+	tw := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "  OUTCOME\tRUNS\tSHARE\n")
+	row := func(outcome string, n int64) {
+		fmt.Fprintf(tw, "  %s\t%d\t%.3g%%\n", outcome, n, 100*float64(n)/float64(total))
+	}
+	for _, status := range statuses {
+		row(status, es.counts[status])
+	}
+	row("passed", passed)
+	tw.Flush()
+	log.Printf("Exit statuses:")
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		log.Print(line)
+	}
+}
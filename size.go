@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A byteSize is a flag.Value for sizes such as "512KB" or "2GiB".
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+func (s *byteSize) Set(v string) error {
+	num, mult := v, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(v), strings.ToUpper(u.suffix)) {
+			num, mult = v[:len(v)-len(u.suffix)], u.n
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = byteSize(f * float64(mult))
+	return nil
+}
+
+func (s byteSize) String() string {
+	switch {
+	case s >= 1<<30:
+		return fmt.Sprintf("%.3gGiB", float64(s)/(1<<30))
+	case s >= 1<<20:
+		return fmt.Sprintf("%.3gMiB", float64(s)/(1<<20))
+	case s >= 1<<10:
+		return fmt.Sprintf("%.3gKiB", float64(s)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", int64(s))
+}
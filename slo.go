@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A failureGate is a pass/fail policy for a session given with -gate: the
+// failure rate must be below maxRate with the given confidence.
+type failureGate struct {
+	spec       string
+	maxRate    float64
+	confidence float64
+}
+
+var failureGateRx = regexp.MustCompile(`^rate\s*<\s*([0-9.]+%?)\s*@\s*([0-9.]+%?)$`)
+
+// parseFailureGate parses a gate such as "rate<0.5% @ 95%".
+func parseFailureGate(s string) (*failureGate, error) {
+	m := failureGateRx.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("%q is not of the form 'rate<0.5%% @ 95%%'", s)
+	}
+	rate, err := parsePercent(m[1])
+	if err != nil {
+		return nil, err
+	}
+	confidence, err := parseConfidence(m[2])
+	if err != nil {
+		return nil, err
+	}
+	return &failureGate{spec: s, maxRate: rate, confidence: confidence}, nil
+}
+
+func parseConfidence(s string) (float64, error) {
+	confidence, err := parsePercent(s)
+	if err != nil {
+		return 0, err
+	}
+	if confidence < 0.5 || confidence >= 1 {
+		return 0, fmt.Errorf("confidence %s is not in [50%%, 100%%)", s)
+	}
+	return confidence, nil
+}
+
+// parseVerify parses the -verify failure rate (a fraction such as 0.001 or a
+// percentage such as 0.1%) and the -verify-confidence level as a gate.
+func parseVerify(rate, confidence string) (*failureGate, error) {
+	var g failureGate
+	var err error
+	if strings.HasSuffix(rate, "%") {
+		g.maxRate, err = parsePercent(rate)
+	} else if g.maxRate, err = strconv.ParseFloat(rate, 64); err == nil && (g.maxRate <= 0 || g.maxRate >= 1) {
+		err = fmt.Errorf("%s is not a rate in (0, 1)", rate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.confidence, err = parseConfidence(confidence); err != nil {
+		return nil, err
+	}
+	g.spec = fmt.Sprintf("rate<%g%% @ %g%%", 100*g.maxRate, 100*g.confidence)
+	return &g, nil
+}
+
+// runsNeeded returns how many runs without a failure meet the gate.
+func (g *failureGate) runsNeeded() int64 {
+	z := math.Sqrt2 * math.Erfinv(2*g.confidence-1)
+	// With no failures, the upper bound is z²/(n+z²).
+	return int64(z*z*(1-g.maxRate)/g.maxRate) + 1
+}
+
+// evaluate reports whether failures out of runs meets the gate, along with
+// an explanation. It uses the upper end of the one-sided Wilson score
+// interval for the failure rate.
+func (g *failureGate) evaluate(failures, runs int64) (bool, string) {
+	if runs == 0 {
+		return false, fmt.Sprintf("Gate %s: failed (no runs)", g.spec)
+	}
+	z := math.Sqrt2 * math.Erfinv(2*g.confidence-1)
+	p := float64(failures) / float64(runs)
+	_, upper := wilsonInterval(failures, runs, z)
+	ok := upper < g.maxRate
+	verdict := "passed"
+	if !ok {
+		verdict = "failed"
+	}
+	return ok, fmt.Sprintf("Gate %s: %s (%d failure(s) in %d run(s): rate %.3g%%, at most %.3g%% with %g%% confidence)",
+		g.spec, verdict, failures, runs, 100*p, 100*upper, 100*g.confidence)
+}
+
+// wilsonInterval returns the Wilson score interval for the failure rate
+// given failures out of runs, with z standard deviations on each side.
+func wilsonInterval(failures, runs int64, z float64) (lower, upper float64) {
+	n := float64(runs)
+	p := float64(failures) / n
+	center := p + z*z/(2*n)
+	spread := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n))
+	return max(0, (center-spread)/(1+z*z/n)), (center + spread) / (1 + z*z/n)
+}
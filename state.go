@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A stateRecord is the line of a -state file describing how one run was
+// configured, with enough detail to repeat it later.
+type stateRecord struct {
+	ID      int64    `json:"id"`
+	Worker  int      `json:"worker"`
+	Args    []string `json:"args"`
+	Env     []string `json:"env,omitempty"`
+	Wrapper []string `json:"wrapper,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Fixture string   `json:"fixture,omitempty"`
+	Chaos   string   `json:"chaos,omitempty"`
+	Seccomp string   `json:"seccomp,omitempty"`
+	Variant string   `json:"variant,omitempty"`
+
+	// With -proxy, the faults, their delay, and the session seed, from
+	// which the proxy's choices for the run derive.
+	Proxy      string `json:"proxy,omitempty"`
+	ProxyDelay string `json:"proxy_delay,omitempty"`
+	Seed       uint64 `json:"seed,omitempty"`
+}
+
+func (rec *stateRecord) config() (runConfig, error) {
+	rc := runConfig{
+		cmd:     &command{args: rec.Args, env: rec.Env, dir: rec.Dir, wrapper: rec.Wrapper},
+		fixture: rec.Fixture,
+		chaos:   rec.Chaos,
+		seccomp: rec.Seccomp,
+		variant: variantNamed(rec.Variant),
+		seed:    rec.Seed,
+	}
+	if rec.Proxy != "" {
+		var err error
+		if rc.proxy, err = parseProxyFaults(rec.Proxy); err != nil {
+			return rc, fmt.Errorf("bad proxy faults: %s", err)
+		}
+		if rc.proxyDelay, err = time.ParseDuration(rec.ProxyDelay); err != nil {
+			return rc, fmt.Errorf("bad proxy delay: %s", err)
+		}
+	}
+	return rc, nil
+}
+
+// A stateWriter records the configuration of every run of a session, one
+// JSON object per line, as the runs start.
+type stateWriter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	err error // first write error
+}
+
+func createState(name string) (*stateWriter, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &stateWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *stateWriter) record(id int64, worker int, rc runConfig) {
+	rec := stateRecord{
+		ID:      id,
+		Worker:  worker,
+		Args:    rc.cmd.args,
+		Env:     rc.cmd.env,
+		Wrapper: rc.cmd.wrapper,
+		Dir:     rc.cmd.dir,
+		Fixture: rc.fixture,
+		Chaos:   rc.chaos,
+		Seccomp: rc.seccomp,
+	}
+	if rc.variant != nil {
+		rec.Variant = rc.variant.name
+	}
+	if rc.proxy != nil {
+		rec.Proxy = rc.proxy.spec
+		rec.ProxyDelay = rc.proxyDelay.String()
+		rec.Seed = rc.seed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(&rec); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *stateWriter) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.f.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+	return s.err
+}
+
+// readStateRecord finds the record of run id in the -state file name.
+func readStateRecord(name string, id int64) (*stateRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var rec stateRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err)
+		}
+		if rec.ID == id {
+			if len(rec.Args) == 0 {
+				return nil, fmt.Errorf("%s:%d: no command", name, line)
+			}
+			return &rec, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s has no record of iteration %d", name, id)
+}
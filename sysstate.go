@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// sysStateCommands are shell commands whose output describes the state of
+// the system. Alternatives are given for tools that vary by platform.
+var sysStateCommands = []string{
+	"ps -eo pid,ppid,pgid,stat,etime,pcpu,rss,args --forest 2>/dev/null || ps -ef",
+	"ss -tanp 2>/dev/null || netstat -an",
+	"df -h",
+	"free -m 2>/dev/null || vm_stat",
+	"uptime",
+	"ulimit -a",
+	"dmesg 2>&1 | tail -n 50",
+}
+
+const sysStateTimeout = 5 * time.Second
+
+// captureSysState runs sysStateCommands and returns their combined output.
+func captureSysState() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "System state at %s\n", time.Now().Format(time.RFC3339))
+	for _, c := range sysStateCommands {
+		ctx, cancel := context.WithTimeout(context.Background(), sysStateTimeout)
+		out, err := exec.CommandContext(ctx, "sh", "-c", c).CombinedOutput()
+		cancel()
+		fmt.Fprintf(&buf, "\n$ %s\n%s", c, out)
+		if err != nil {
+			fmt.Fprintf(&buf, "(%s)\n", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// saveSysState writes the system state snapshot of a failed run to a file,
+// in the run's tmpdir if it was kept, and returns the file name.
+func saveSysState(re *runError) (string, error) {
+	if re.tmpdir != "" {
+		name := filepath.Join(re.tmpdir, "flake-sysstate.txt")
+		return name, os.WriteFile(name, re.sysState, 0o644)
+	}
+	f, err := os.CreateTemp("", "flake-sysstate-*.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(re.sysState); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
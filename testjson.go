@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A testEvent is an event in the output of go test -json (see
+// go doc cmd/test2json).
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+// A testFailure is a failed test (or a failed package, if test is empty)
+// from go test -json output.
+type testFailure struct {
+	pkg     string
+	test    string
+	elapsed float64
+	output  string
+}
+
+func (f *testFailure) name() string {
+	if f.test == "" {
+		return f.pkg
+	}
+	return f.test
+}
+
+// parseTestJSON parses go test -json output. It returns the failed tests,
+// leaving out tests that only failed because a subtest did, and the output
+// as go test would have printed it without -json. Lines that are not JSON
+// (such as build errors) are kept in the text as they are.
+func parseTestJSON(out []byte) ([]*testFailure, []byte) {
+	var text bytes.Buffer
+	type key struct{ pkg, test string }
+	outputs := make(map[key]*strings.Builder)
+	var failures []*testFailure
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var ev testEvent
+		if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &ev) != nil {
+			text.Write(line)
+			text.WriteByte('\n')
+			continue
+		}
+		k := key{ev.Package, ev.Test}
+		switch ev.Action {
+		case "output":
+			text.WriteString(ev.Output)
+			b := outputs[k]
+			if b == nil {
+				b = new(strings.Builder)
+				outputs[k] = b
+			}
+			b.WriteString(ev.Output)
+		case "fail":
+			f := &testFailure{pkg: ev.Package, test: ev.Test, elapsed: ev.Elapsed}
+			if b := outputs[k]; b != nil {
+				f.output = b.String()
+			}
+			failures = append(failures, f)
+		}
+	}
+
+	// Leave out tests with failed subtests, and packages with failed tests.
+	var leaves []*testFailure
+	for _, f := range failures {
+		leaf := true
+		for _, g := range failures {
+			if g.pkg != f.pkg || g == f {
+				continue
+			}
+			if f.test == "" && g.test != "" || f.test != "" && strings.HasPrefix(g.test, f.test+"/") {
+				leaf = false
+				break
+			}
+		}
+		if leaf {
+			leaves = append(leaves, f)
+		}
+	}
+	return leaves, text.Bytes()
+}
+
+// formatTestFailures describes failed tests, each with its own output.
+func formatTestFailures(failures []*testFailure) string {
+	var b strings.Builder
+	for _, f := range failures {
+		fmt.Fprintf(&b, "--- %s (%s, %.2fs):\n%s", f.name(), f.pkg, f.elapsed, f.output)
+		if !strings.HasSuffix(f.output, "\n") {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A traceRecorder collects the runs of a session for export in the Trace
+// Event Format understood by Perfetto and chrome://tracing.
+type traceRecorder struct {
+	start  time.Time
+	events []traceEvent
+}
+
+type traceEvent struct {
+	Name  string            `json:"name"`
+	Phase string            `json:"ph"`
+	TS    int64             `json:"ts"` // microseconds
+	Dur   int64             `json:"dur,omitempty"`
+	PID   int               `json:"pid"`
+	TID   int               `json:"tid"`
+	Scope string            `json:"s,omitempty"`
+	Args  map[string]string `json:"args,omitempty"`
+}
+
+func newTraceRecorder(start time.Time) *traceRecorder {
+	return &traceRecorder{start: start}
+}
+
+func (t *traceRecorder) addWorker(num int) {
+	t.events = append(t.events, traceEvent{
+		Name:  "thread_name",
+		Phase: "M",
+		PID:   1,
+		TID:   num,
+		Args:  map[string]string{"name": fmt.Sprintf("worker %d", num)},
+	})
+}
+
+func (t *traceRecorder) addRun(r runResult) {
+	ev := traceEvent{
+		Name:  fmt.Sprintf("run %d", r.id),
+		Phase: "X",
+		TS:    r.start.Sub(t.start).Microseconds(),
+		Dur:   r.elapsed.Microseconds(),
+		PID:   1,
+		TID:   r.worker,
+		Args:  map[string]string{"command": r.config.cmd.String()},
+	}
+	if r.config.chaos != "" {
+		ev.Args["chaos"] = r.config.chaos
+	}
+	if r.config.seccomp != "" {
+		ev.Args["seccomp"] = r.config.seccomp
+	}
+	if r.err == nil {
+		ev.Args["result"] = "ok"
+		t.events = append(t.events, ev)
+		return
+	}
+	ev.Name += " (failed)"
+	ev.Args["result"] = r.err.Error()
+	t.events = append(t.events, ev)
+	// Mark the failure across all tracks.
+	t.events = append(t.events, traceEvent{
+		Name:  fmt.Sprintf("run %d failed", r.id),
+		Phase: "i",
+		TS:    ev.TS + ev.Dur,
+		PID:   1,
+		TID:   r.worker,
+		Scope: "g",
+	})
+}
+
+func (t *traceRecorder) writeFile(name string) error {
+	b, err := json.Marshal(struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{t.events})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0o644)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// A suspect is one of the commands being triaged.
+type suspect struct {
+	line     string // as written in the commands file
+	cmd      *command
+	runs     int
+	failures int
+	inFlight int
+	first    error // first failure, if any
+}
+
+// A triage splits a time budget across suspects, choosing each run with the
+// UCB1 multi-armed-bandit rule so that suspects that fail early get more of
+// the budget than ones that keep passing.
+type triage struct {
+	mu       sync.Mutex
+	suspects []*suspect
+	total    int // finished runs
+}
+
+// next chooses the suspect for the next run and marks it in flight.
+func (t *triage) next() *suspect {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var best *suspect
+	var bestScore float64
+	for _, s := range t.suspects {
+		n := s.runs + s.inFlight
+		if n == 0 {
+			best = s
+			break
+		}
+		rate := float64(s.failures) / float64(max(s.runs, 1))
+		score := rate + math.Sqrt(2*math.Log(float64(t.total+1))/float64(n))
+		if best == nil || score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	best.inFlight++
+	return best
+}
+
+// done records the result of a run of s. Runs that were cut short by the end
+// of the budget (done is false) are not counted.
+func (t *triage) done(s *suspect, err error, finished bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.inFlight--
+	if !finished {
+		return
+	}
+	s.runs++
+	t.total++
+	if err != nil {
+		s.failures++
+		if s.first == nil {
+			s.first = err
+		}
+	}
+}
+
+func (t *triage) report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ranked := append([]*suspect(nil), t.suspects...)
+	rate := func(s *suspect) float64 {
+		if s.runs == 0 {
+			return 0
+		}
+		return float64(s.failures) / float64(s.runs)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		ri, rj := rate(ranked[i]), rate(ranked[j])
+		if ri != rj {
+			return ri > rj
+		}
+		return ranked[i].runs > ranked[j].runs
+	})
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tFAILURES\tRUNS\tRATE\tCOMMAND\tFIRST FAILURE")
+	for i, s := range ranked {
+		first := "-"
+		if s.first != nil {
+			first = s.first.Error()
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.2f%%\t%s\t%s\n", i+1, s.failures, s.runs, 100*rate(s), s.line, first)
+	}
+	tw.Flush()
+}
+
+// readSuspects reads a list of commands (from a commands file, or from stdin
+// with flake -stdin-commands): one shell command per line, ignoring blank
+// lines and lines starting with #.
+func readSuspects(r io.Reader) ([]*suspect, error) {
+	var suspects []*suspect
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args := shellCommand(context.Background(), line).Args
+		suspects = append(suspects, &suspect{line: line, cmd: &command{args: args}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(suspects) == 0 {
+		return nil, errors.New("no commands")
+	}
+	return suspects, nil
+}
+
+// triageFlags defines the flags of flake triage.
+func triageFlags() (fs *flag.FlagSet, budget *time.Duration, parallelism *int) {
+	fs = flag.NewFlagSet("flake triage", flag.ExitOnError)
+	budget = fs.Duration("budget", 0, "Spend this long in total (required)")
+	parallelism = fs.Int("p", runtime.GOMAXPROCS(0), "Run this many processes in parallel")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage:
+
+  flake triage -budget <duration> [flags...] <file>
+
+where the flags are:
+
+`)
+		fs.PrintDefaults()
+		fmt.Fprint(os.Stderr, `
+Flake triage runs each command in the file (one shell command per line; blank
+lines and lines starting with # are ignored) repeatedly, splitting the budget
+between them. Commands that fail get more of the budget, to find out how
+often they fail. At the end (or on ^C), flake prints the commands ranked by
+failure rate.
+`)
+	}
+	return fs, budget, parallelism
+}
+
+func triageMain(args []string) {
+	fs, budget, parallelism := triageFlags()
+	fs.Parse(args)
+	if *budget <= 0 || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *parallelism < 1 {
+		log.Fatalln("-p must be positive")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln("Cannot read commands:", err)
+	}
+	suspects, err := readSuspects(f)
+	f.Close()
+	if err != nil {
+		log.Fatalln("Cannot read commands:", err)
+	}
+	runTriage(suspects, *budget, 0, *parallelism)
+}
+
+// runTriage runs suspects until the time budget (if positive) is spent or
+// maxRuns runs (if positive) have started, then reports them.
+func runTriage(suspects []*suspect, budget time.Duration, maxRuns int64, parallelism int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if budget > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), budget)
+	}
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var limits []string
+	if budget > 0 {
+		limits = append(limits, budget.String())
+	}
+	if maxRuns > 0 {
+		limits = append(limits, fmt.Sprintf("%d run(s)", maxRuns))
+	}
+	log.Printf("Triaging %d command(s) for %s", len(suspects), strings.Join(limits, " or "))
+	t := &triage{suspects: suspects}
+	var leaks leakAudit
+	var wg sync.WaitGroup
+	var id int64
+	for i := 1; i <= parallelism; i++ {
+		w := &worker{num: i, numaNode: -1, leaks: &leaks}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				runID := atomic.AddInt64(&id, 1)
+				if maxRuns > 0 && runID > maxRuns {
+					return
+				}
+				s := t.next()
+				err := w.run(ctx, runID, runConfig{cmd: s.cmd})
+				t.done(s, err, ctx.Err() == nil)
+			}
+		}()
+	}
+	wg.Wait()
+	t.report()
+	if s := leaks.String(); s != "" {
+		log.Printf("Warning: %s", s)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+)
+
+// A variant is one arm of an experiment that alternates runs between
+// different ways of running the command.
+type variant struct {
+	name      string
+	cmd       *command // run this instead of the command, if non-nil
+	coldCache bool     // give each run empty build caches
+}
+
+// cacheVariants alternate between empty (cold) build caches and the user's
+// existing (warm) ones.
+var cacheVariants = []*variant{
+	{name: "cold cache", coldCache: true},
+	{name: "warm cache"},
+}
+
+// raceVariants alternate between a go test command with and without the
+// race detector.
+func raceVariants(c *command) ([]*variant, error) {
+	if len(c.args) < 2 || filepath.Base(c.args[0]) != "go" || c.args[1] != "test" {
+		return nil, errors.New("the command is not 'go test'")
+	}
+	race := &command{env: c.env, wrapper: c.wrapper}
+	noRace := &command{env: c.env, wrapper: c.wrapper}
+	for i, arg := range c.args {
+		if arg == "-race" || arg == "--race" || arg == "-race=true" {
+			continue
+		}
+		race.args = append(race.args, arg)
+		noRace.args = append(noRace.args, arg)
+		if i == 1 {
+			race.args = append(race.args, "-race")
+		}
+	}
+	return []*variant{
+		{name: "race", cmd: race},
+		{name: "no race", cmd: noRace},
+	}, nil
+}
+
+// compareVariants alternate between the command (A) and another command
+// (B), given as a shell command line.
+func compareVariants(other string) []*variant {
+	b := &command{args: shellCommand(context.Background(), other).Args}
+	return []*variant{
+		{name: "A"},
+		{name: "B", cmd: b},
+	}
+}
+
+// variantNamed returns the variant with the given name, or nil.
+func variantNamed(name string) *variant {
+	for _, v := range cacheVariants {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// coldCacheEnv returns the environment variables that point a run's caches
+// into dir.
+func coldCacheEnv(dir string) []string {
+	return []string{
+		"GOCACHE=" + dir + "/go-build",
+		"XDG_CACHE_HOME=" + dir + "/xdg",
+	}
+}
+
+type variantStats struct {
+	v        *variant
+	runs     int64
+	failures int64
+}
+
+func (s *variantStats) rate() float64 {
+	if s.runs == 0 {
+		return 0
+	}
+	return float64(s.failures) / float64(s.runs)
+}
+
+// reportVariants prints the failure rate of each variant of an experiment
+// and, for two variants, whether the difference is statistically
+// significant.
+func reportVariants(stats []*variantStats) {
+	log.Printf("Experiment results:")
+	for _, s := range stats {
+		log.Printf("  %s: %d failure(s) in %d run(s) (%.3g%%)", s.v.name, s.failures, s.runs, 100*s.rate())
+	}
+	if len(stats) != 2 {
+		return
+	}
+	a, b := stats[0], stats[1]
+	if a.runs == 0 || b.runs == 0 {
+		return
+	}
+	if p := fisherExact(a.failures, a.runs, b.failures, b.runs); p < 0.05 {
+		more := a
+		if b.rate() > a.rate() {
+			more = b
+		}
+		log.Printf("Failures are significantly more likely with %s (p = %.2g).", more.v.name, p)
+	} else {
+		log.Printf("The difference is not statistically significant (p = %.2g).", p)
+	}
+}
+
+// fisherExact returns the two-sided p-value of Fisher's exact test of
+// whether failure rates a and b differ. Unlike tests based on the normal
+// approximation, it holds up for the handful of failures that flaky
+// commands produce.
+func fisherExact(aFailures, aRuns, bFailures, bRuns int64) float64 {
+	// Given the total failures, the failures in a follow a
+	// hypergeometric distribution; sum the probabilities of the outcomes
+	// that are no more likely than the observed one.
+	failures, runs := aFailures+bFailures, aRuns+bRuns
+	logChoose := func(n, k int64) float64 {
+		a, _ := math.Lgamma(float64(n + 1))
+		b, _ := math.Lgamma(float64(k + 1))
+		c, _ := math.Lgamma(float64(n - k + 1))
+		return a - b - c
+	}
+	logTotal := logChoose(runs, aRuns)
+	prob := func(x int64) float64 {
+		return math.Exp(logChoose(failures, x) + logChoose(runs-failures, aRuns-x) - logTotal)
+	}
+	observed := prob(aFailures)
+	var p float64
+	for x := max(0, aRuns-(runs-failures)); x <= min(failures, aRuns); x++ {
+		if px := prob(x); px <= observed*(1+1e-7) {
+			p += px
+		}
+	}
+	return min(p, 1)
+}
+
+func (s *variantStats) String() string {
+	return fmt.Sprintf("%s %d/%d", s.v.name, s.failures, s.runs)
+}